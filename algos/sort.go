@@ -1,11 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"cmp"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"iter"
+	"math"
+	"math/bits"
+	"math/rand"
 	"os"
 	"reflect"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
 // https://stackoverflow.com/a/7053871
@@ -38,9 +51,272 @@ func FillUint16Array(xs []uint16, seed uint16) uint16 {
 	return XorShift16(seed)
 }
 
+// Returns a number in [0, n) scaled from a random seed
+func randomIndex(seed uint16, n int) int {
+	return int(uint64(seed) * uint64(n) >> 16)
+}
+
+// Fills xs with random non-decreasing numbers, steps between them are small enough not to overflow
+func FillSortedUint16Array(xs []uint16, seed uint16) uint16 {
+	maxStep := max(1, (1<<16)/(len(xs)+1))
+	var x uint16
+	for i := 0; i < len(xs); i++ {
+		seed = XorShift16(seed)
+		x += uint16(randomIndex(seed, maxStep))
+		xs[i] = x
+	}
+	return XorShift16(seed)
+}
+
+func FillReverseSortedUint16Array(xs []uint16, seed uint16) uint16 {
+	seed = FillSortedUint16Array(xs, seed)
+	reverse(xs)
+	return seed
+}
+
+// Fills xs with sorted numbers and exchanges k random pairs of them
+func FillNearlySortedUint16Array(xs []uint16, seed uint16, k int) uint16 {
+	seed = FillSortedUint16Array(xs, seed)
+	if len(xs) == 0 {
+		return seed
+	}
+	for ; k > 0; k-- {
+		i := randomIndex(seed, len(xs))
+		seed = XorShift16(seed)
+		j := randomIndex(seed, len(xs))
+		seed = XorShift16(seed)
+		Exchange(&xs[i], &xs[j])
+	}
+	return seed
+}
+
+// Fills xs with numbers ascending up to the middle and then descending symmetrically
+func FillOrganPipeUint16Array(xs []uint16, seed uint16) uint16 {
+	n := len(xs)
+	seed = FillSortedUint16Array(xs[:(n+1)/2], seed)
+	for i := 0; i < n/2; i++ {
+		xs[n-1-i] = xs[i]
+	}
+	return seed
+}
+
+// Number of ascending runs in sawtooth inputs
+const sawtoothTeeth = 8
+
+// Fills xs with sawtoothTeeth ascending runs of sorted numbers
+func FillSawtoothUint16Array(xs []uint16, seed uint16) uint16 {
+	tooth := max(1, (len(xs)+sawtoothTeeth-1)/sawtoothTeeth)
+	for l := 0; l < len(xs); l += tooth {
+		seed = FillSortedUint16Array(xs[l:min(l+tooth, len(xs))], seed)
+	}
+	return seed
+}
+
+// Number of distinct numbers in few-unique inputs
+const fewUniqueValues = 8
+
+// Fills xs with numbers randomly chosen from fewUniqueValues random ones
+func FillFewUniqueUint16Array(xs []uint16, seed uint16) uint16 {
+	var values [fewUniqueValues]uint16
+	for i := range values {
+		seed = XorShift16(seed)
+		values[i] = seed
+	}
+	for i := 0; i < len(xs); i++ {
+		seed = XorShift16(seed)
+		xs[i] = values[randomIndex(seed, fewUniqueValues)]
+	}
+	return XorShift16(seed)
+}
+
+func FillAllEqualUint16Array(xs []uint16, seed uint16) uint16 {
+	seed = XorShift16(seed)
+	for i := 0; i < len(xs); i++ {
+		xs[i] = seed
+	}
+	return XorShift16(seed)
+}
+
+// Exponent of the Zipf distribution, the probability of k is proportional to 1/k^zipfExponent
+const zipfExponent = 1.2
+
+// Fills xs with numbers from the Zipf distribution, so that small numbers repeat a lot and large ones are rare
+func FillZipfUint16Array(xs []uint16, seed uint16) uint16 {
+	zipf := rand.NewZipf(rand.New(rand.NewSource(int64(seed))), zipfExponent, 1, math.MaxUint16)
+	for i := 0; i < len(xs); i++ {
+		xs[i] = uint16(zipf.Uint64())
+	}
+	return XorShift16(seed)
+}
+
+// Number of random exchanges in nearly sorted inputs is len(xs)/nearlySortedSwapsDivisor + 1
+const nearlySortedSwapsDivisor = 32
+
+// Input distributions sorted by the test harness
+var inputDistributions = []struct {
+	name string
+	fill func(xs []uint16, seed uint16) uint16
+}{
+	{"uniform", FillUint16Array},
+	{"sorted", FillSortedUint16Array},
+	{"reverse sorted", FillReverseSortedUint16Array},
+	{"nearly sorted", func(xs []uint16, seed uint16) uint16 {
+		return FillNearlySortedUint16Array(xs, seed, len(xs)/nearlySortedSwapsDivisor+1)
+	}},
+	{"organ pipe", FillOrganPipeUint16Array},
+	{"sawtooth", FillSawtoothUint16Array},
+	{"few unique", FillFewUniqueUint16Array},
+	{"all equal", FillAllEqualUint16Array},
+	{"zipf", FillZipfUint16Array},
+}
+
+// Builds an input of length n, on which sort makes as many comparisons as the adversary can force.
+// Based on McIlroy, A Killer Adversary for Quicksort, 1999. Sorts indices of the input with a comparator
+// that decides values of elements lazily: all elements start as "gas" greater than any decided value,
+// and when two gas elements are compared, the one that is likely the pivot is frozen to the next smallest value.
+// Quicksorts that choose pivots with a constant number of comparisons become quadratic on the result.
+// Assumes that sort is deterministic and only compares elements it was given, so that it makes
+// the same comparisons when given the result, which are returned along with it.
+func AntiQuickSort(n int, sort func(xs []int, cmp func(a, b int) int)) ([]int, int) {
+	gas := n - 1
+	values := make([]int, n)
+	xs := make([]int, n)
+	for i := range xs {
+		values[i] = gas
+		xs[i] = i
+	}
+
+	solid, candidate, comparisons := 0, 0, 0
+	freeze := func(x int) {
+		values[x] = solid
+		solid++
+	}
+	sort(xs, func(x, y int) int {
+		comparisons++
+		if values[x] == gas && values[y] == gas {
+			if x == candidate {
+				freeze(x)
+			} else {
+				freeze(y)
+			}
+		}
+		if values[x] == gas {
+			candidate = x
+		} else if values[y] == gas {
+			candidate = y
+		}
+		return cmp.Compare(values[x], values[y])
+	})
+	return values, comparisons
+}
+
+// Inputs of length n that make quicksort with median-of-three partitioning, as in HybridQuickSort, quadratic
+// unless it falls back to another sort. Built by AntiQuickSort on medianOfThreeQuickSort without the depth limit.
+// Killers of lengths 64, 256 and 1024 are precomputed in testdata/median_of_three_killers.txt, one per line.
+func MedianOfThreeKiller(n int) []int {
+	xs, _ := AntiQuickSort(n, func(xs []int, cmp func(a, b int) int) {
+		medianOfThreeQuickSort(xs, math.MaxInt, cmp)
+		InsertionSort2Func(xs, cmp)
+	})
+	return xs
+}
+
+// Counts of operations made by a sort, collected by Instrument
+type SortStats struct {
+	// Calls of the comparator
+	Comparisons int
+	// Calls of Exchange, including the ones made by CompareExchange
+	Exchanges int
+	// Writes of elements into xs, aux or out: two per exchange plus the ones made by shifting, distributing and merging
+	Moves int
+	// Maximum depth of recursion of quicksorts, selects and top-down merge sorts
+	MaxDepth int
+}
+
+// Counters of the running Instrument. Updated atomically, so that parallel sorts don't race on them.
+type sortCounters struct {
+	exchanges, moves, depth, maxDepth atomic.Int64
+}
+
+var (
+	// Serializes Instrument calls, since all of them share instrumentedCounters
+	instrumentMutex sync.Mutex
+	// Counters of the running Instrument, nil otherwise
+	instrumentedCounters atomic.Pointer[sortCounters]
+)
+
+func statsExchange() {
+	if c := instrumentedCounters.Load(); c != nil {
+		c.exchanges.Add(1)
+		c.moves.Add(2)
+	}
+}
+
+func statsMoves(n int) {
+	if c := instrumentedCounters.Load(); c != nil {
+		c.moves.Add(int64(n))
+	}
+}
+
+// Called on entering a recursive call, must be paired with statsLeave
+func statsEnter() {
+	if c := instrumentedCounters.Load(); c != nil {
+		d := c.depth.Add(1)
+		for {
+			m := c.maxDepth.Load()
+			if d <= m || c.maxDepth.CompareAndSwap(m, d) {
+				break
+			}
+		}
+	}
+}
+
+func statsLeave() {
+	if c := instrumentedCounters.Load(); c != nil {
+		c.depth.Add(-1)
+	}
+}
+
+// Calls fn with a comparator that counts calls of cmp and returns the counts of operations fn made.
+// Usually fn calls one of ...Func variants, for example:
+//
+//	stats := Instrument(cmp.Compare[int], func(cmp func(a, b int) int) { QuickSortFunc(xs, cmp) })
+//
+// Comparisons are counted by the comparator, so they belong to this call only. The other counts are
+// collected by the sorts themselves, so Instrument calls wait for each other, and sorts that run
+// at the same time outside of fn are counted too. Exchanges and moves of parallel sorts are summed
+// over their goroutines, but MaxDepth is only meaningful for sequential sorts, since the depths
+// of concurrent recursive calls add up.
+func Instrument[T any](cmp func(a, b T) int, fn func(cmp func(a, b T) int)) SortStats {
+	instrumentMutex.Lock()
+	defer instrumentMutex.Unlock()
+	c := &sortCounters{}
+	instrumentedCounters.Store(c)
+	defer instrumentedCounters.Store(nil)
+
+	var comparisons atomic.Int64
+	fn(func(a, b T) int {
+		comparisons.Add(1)
+		return cmp(a, b)
+	})
+	return SortStats{
+		Comparisons: int(comparisons.Load()),
+		Exchanges:   int(c.exchanges.Load()),
+		Moves:       int(c.moves.Load()),
+		MaxDepth:    int(c.maxDepth.Load()),
+	}
+}
+
 func IsSorted[T cmp.Ordered](xs []T) bool {
+	return IsSortedFunc(xs, cmp.Compare[T])
+}
+
+// ...Func variants compare elements using cmp, which returns a negative number when a < b,
+// a positive number when a > b and zero otherwise, like cmp.Compare does.
+// Ordered variants call them with cmp.Compare.
+func IsSortedFunc[T any](xs []T, cmp func(a, b T) int) bool {
 	for i := 0; i < len(xs)-1; i++ {
-		if cmp.Compare(xs[i], xs[i+1]) == 1 {
+		if cmp(xs[i], xs[i+1]) > 0 {
 			return false
 		}
 	}
@@ -48,30 +324,65 @@ func IsSorted[T cmp.Ordered](xs []T) bool {
 }
 
 func Exchange[T any](A, B *T) {
+	statsExchange()
 	*A, *B = *B, *A
 }
 
 func CompareExchange[T cmp.Ordered](A, B *T) {
-	if cmp.Less(*B, *A) {
+	CompareExchangeFunc(A, B, cmp.Compare[T])
+}
+
+func CompareExchangeFunc[T any](A, B *T, cmp func(a, b T) int) {
+	if cmp(*B, *A) < 0 {
 		Exchange(A, B)
 	}
 }
 
+// Same as CompareExchange, but doesn't branch on the values: the result of the comparison is turned into a mask
+// which selects the values, and both of them are always written. So the time it takes doesn't depend on the values,
+// as far as the compiler keeps the code branchless, which Go doesn't guarantee.
+// For the same reason Instrument doesn't count its exchanges and moves.
+func CompareExchangeBranchless[T Integer](A, B *T) {
+	a, b := uint64(*A), uint64(*B)
+
+	// Flipping the sign bit of signed values, which are sign-extended, orders them like unsigned ones
+	var zero T
+	var flip uint64
+	if ^zero < 0 {
+		flip = 1 << 63
+	}
+
+	// Borrow is 1 if b < a
+	_, borrow := bits.Sub64(b^flip, a^flip, 0)
+	d := (a ^ b) & -borrow
+	*A, *B = T(a^d), T(b^d)
+}
+
 // Based on Sedgewick, Algorithms in C++, prog. 6.1.
+// Stable.
 func InsertionSort[T cmp.Ordered](xs []T) {
+	InsertionSortFunc(xs, cmp.Compare[T])
+}
+
+func InsertionSortFunc[T any](xs []T, cmp func(a, b T) int) {
 	for i := 1; i < len(xs); i++ {
 		// "Sink" the current element to the left while it is smaller
 		for j := i; j > 0; j-- {
-			CompareExchange(&xs[j-1], &xs[j])
+			CompareExchangeFunc(&xs[j-1], &xs[j], cmp)
 		}
 	}
 }
 
 // Based on Sedgewick, Algorithms in C++, prog. 6.3.
+// Stable.
 func InsertionSort2[T cmp.Ordered](xs []T) {
+	InsertionSort2Func(xs, cmp.Compare[T])
+}
+
+func InsertionSort2Func[T any](xs []T, cmp func(a, b T) int) {
 	// Make the leftmost element the "signal" element -- it is less than or equal to other elements
 	for i := len(xs) - 1; i > 0; i-- {
-		CompareExchange(&xs[i-1], &xs[i])
+		CompareExchangeFunc(&xs[i-1], &xs[i], cmp)
 	}
 
 	// Start from index 2 because the first element is already the smallest one
@@ -80,23 +391,29 @@ func InsertionSort2[T cmp.Ordered](xs []T) {
 		j, v := i, xs[i]
 
 		// Move elements that are to the left of the current and are greater than it one position to the right
-		for v < xs[j-1] {
+		for cmp(v, xs[j-1]) < 0 {
 			xs[j] = xs[j-1]
 			j--
 		}
 
 		// Insert the current element at the freed position
 		xs[j] = v
+		statsMoves(i - j + 1)
 	}
 }
 
 // Based on Sedgewick, Algorithms in C++, prog. 6.2.
+// Not stable.
 func SelectionSort[T cmp.Ordered](xs []T) {
+	SelectionSortFunc(xs, cmp.Compare[T])
+}
+
+func SelectionSortFunc[T any](xs []T, cmp func(a, b T) int) {
 	for i := 0; i < len(xs); i++ {
 		// Find the minimal element to the right of the current
 		min := i
 		for j := i + 1; j < len(xs); j++ {
-			if cmp.Less(xs[j], xs[min]) {
+			if cmp(xs[j], xs[min]) < 0 {
 				min = j
 			}
 		}
@@ -107,23 +424,33 @@ func SelectionSort[T cmp.Ordered](xs []T) {
 }
 
 // Based on Sedgewick, Algorithms in C++, prog. 6.4.
+// Stable.
 func BubbleSort[T cmp.Ordered](xs []T) {
+	BubbleSortFunc(xs, cmp.Compare[T])
+}
+
+func BubbleSortFunc[T any](xs []T, cmp func(a, b T) int) {
 	for i := 0; i < len(xs); i++ {
 		// "Sink" the least element to the right of the current one down to the current position
 		for j := len(xs) - 1; j > i; j-- {
-			CompareExchange(&xs[j-1], &xs[j])
+			CompareExchangeFunc(&xs[j-1], &xs[j], cmp)
 		}
 	}
 }
 
 // Based on Sedgewick, Algorithms in C++, prog. 6.4.
 // Uses an optimization similar to Insertion2: finds the smallest element in the right side, shifts elements one position to the right from current and places the smallest one into the current position.
+// Stable.
 func BubbleSort2[T cmp.Ordered](xs []T) {
+	BubbleSort2Func(xs, cmp.Compare[T])
+}
+
+func BubbleSort2Func[T any](xs []T, cmp func(a, b T) int) {
 	for i := 0; i < len(xs); i++ {
 		// Find the index of the least element to the right of the current one
 		min := i
 		for j := i + 1; j < len(xs); j++ {
-			if cmp.Less(xs[j], xs[min]) {
+			if cmp(xs[j], xs[min]) < 0 {
 				min = j
 			}
 		}
@@ -137,11 +464,17 @@ func BubbleSort2[T cmp.Ordered](xs []T) {
 
 		// Place the smallest element into the current position
 		xs[i] = v
+		statsMoves(1)
 	}
 }
 
 // Based on Sedgewick, Algorithms in C++, prog. 6.5.
+// Not stable.
 func ShellSort[T cmp.Ordered](xs []T) {
+	ShellSortFunc(xs, cmp.Compare[T])
+}
+
+func ShellSortFunc[T any](xs []T, cmp func(a, b T) int) {
 	// Find the suitable stride using the 1, 4, 13, 40, 121, 364, … sequence
 	var h int = 1
 	for h <= len(xs)/9 {
@@ -152,395 +485,3231 @@ func ShellSort[T cmp.Ordered](xs []T) {
 	for ; h > 0; h /= 3 {
 		for i := h; i < len(xs); i++ {
 			j, v := i, xs[i]
-			for j >= h && cmp.Less(v, xs[j-h]) {
+			for j >= h && cmp(v, xs[j-h]) < 0 {
 				xs[j] = xs[j-h]
 				j = j - h
 			}
 			xs[j] = v
+			statsMoves((i-j)/h + 1)
 		}
 	}
 }
 
-// From golang.org/x/exp/constraints package
+// Shellsort that takes gaps from a generator, such as one of the ...Gaps functions below.
+// gaps(n) must return increasing gaps for sorting n elements starting with 1, gaps not less than n are skipped.
+// Not stable.
+func ShellSortWithGaps[T cmp.Ordered](xs []T, gaps func(n int) []int) {
+	ShellSortWithGapsFunc(xs, gaps, cmp.Compare[T])
+}
 
-type Signed interface {
-	~int | ~int8 | ~int16 | ~int32 | ~int64
+func ShellSortWithGapsFunc[T any](xs []T, gaps func(n int) []int, cmp func(a, b T) int) {
+	shellSortWithGapsImpl(xs, gaps(len(xs)), cmp)
 }
 
-type Unsigned interface {
-	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+// Returns the number of moves of elements, not counting the ones left in place
+func shellSortWithGapsImpl[T any](xs []T, gaps []int, cmp func(a, b T) int) int {
+	moves := 0
+	for g := len(gaps) - 1; g >= 0; g-- {
+		h := gaps[g]
+		for i := h; i < len(xs); i++ {
+			j, v := i, xs[i]
+			for j >= h && cmp(v, xs[j-h]) < 0 {
+				xs[j] = xs[j-h]
+				j = j - h
+				moves++
+			}
+			if j != i {
+				xs[j] = v
+				moves++
+			}
+		}
+	}
+	statsMoves(moves)
+	return moves
 }
 
-type Integer interface {
-	Signed | Unsigned
+// 1, 4, 13, 40, 121, … up to the first gap greater than n/9, the sequence used by ShellSort
+func KnuthGaps(n int) []int {
+	gaps := []int{1}
+	for h := 1; h <= n/9; {
+		h = 3*h + 1
+		gaps = append(gaps, h)
+	}
+	return gaps
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 6.17.
-func CountSort[T Integer](xs []T) {
-	// TODO: implement
+// 1, 4, 10, 23, 57, 132, 301, 701 found empirically by Ciura, extended by multiplying by 2.25
+func CiuraGaps(n int) []int {
+	gaps := []int{1, 4, 10, 23, 57, 132, 301, 701}
+	for gaps[len(gaps)-1] < n {
+		gaps = append(gaps, gaps[len(gaps)-1]*9/4)
+	}
+	return shellSortGapsBelow(gaps, n)
 }
 
-func BucketSort[T Integer](xs []T) {
-	// TODO: implement
+// 1, 8, 23, 77, 281, …, that is 4^k + 3*2^(k-1) + 1, by Sedgewick (1986)
+func Sedgewick1986Gaps(n int) []int {
+	gaps := []int{1}
+	for k := 1; gaps[len(gaps)-1] < n; k++ {
+		gaps = append(gaps, 1<<(2*k)+3<<(k-1)+1)
+	}
+	return shellSortGapsBelow(gaps, n)
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 7.2.
-func Partition[T cmp.Ordered](xs []T) int {
-	i, j, v := 0, len(xs)-2, xs[len(xs)-1]
+// 1, 4, 9, 20, 46, 103, …, that is ceil(h_k) where h_k = 2.25*h_(k-1) + 1 and h_1 = 1, by Tokuda
+func TokudaGaps(n int) []int {
+	gaps := []int{1}
+	for h := 1.0; gaps[len(gaps)-1] < n; {
+		h = 2.25*h + 1
+		gaps = append(gaps, int(math.Ceil(h)))
+	}
+	return shellSortGapsBelow(gaps, n)
+}
 
-	for {
-		for i < len(xs) && cmp.Less(xs[i], v) {
-			i++
+// 1, 2, 3, 4, 6, 8, 9, 12, …, that is all 2^p*3^q, by Pratt
+func PrattGaps(n int) []int {
+	// Merges multiples of previous gaps by 2 and by 3
+	gaps := []int{1}
+	for i2, i3 := 0, 0; ; {
+		h := min(2*gaps[i2], 3*gaps[i3])
+		if h >= n {
+			break
 		}
-		// xs[i] is the first element that is >= v
-
-		for j >= 0 && cmp.Less(v, xs[j]) {
-			j--
-			if j == 0 {
-				break
-			}
+		gaps = append(gaps, h)
+		if h == 2*gaps[i2] {
+			i2++
 		}
-		// xs[j] is the first element that is <= v
-
-		if i >= j {
-			break
+		if h == 3*gaps[i3] {
+			i3++
 		}
-
-		Exchange(&xs[i], &xs[j])
 	}
+	return gaps
+}
 
-	Exchange(&xs[i], &xs[len(xs)-1])
-	return i
+// 1, 3, 7, 15, 31, …, that is 2^k - 1, by Hibbard
+func HibbardGaps(n int) []int {
+	gaps := []int{1}
+	for h := 3; h < n; h = 2*h + 1 {
+		gaps = append(gaps, h)
+	}
+	return gaps
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 7.1.
-func QuickSort[T cmp.Ordered](xs []T) {
-	if len(xs) <= 1 {
-		return
+// Truncates increasing gaps to the ones less than n, keeping at least 1
+func shellSortGapsBelow(gaps []int, n int) []int {
+	k := 1
+	for k < len(gaps) && gaps[k] < n {
+		k++
 	}
+	return gaps[:k]
+}
 
-	p := Partition(xs)
-	QuickSort(xs[:p])
-	QuickSort(xs[p+1:])
+var shellSortGapSequences = []struct {
+	name string
+	gaps func(n int) []int
+}{
+	{"Knuth", KnuthGaps},
+	{"Ciura", CiuraGaps},
+	{"Sedgewick 1986", Sedgewick1986Gaps},
+	{"Tokuda", TokudaGaps},
+	{"Pratt", PrattGaps},
+	{"Hibbard", HibbardGaps},
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 7.3.
-func NonRecursiveQuickSort[T cmp.Ordered](xs []T) {
-	stack := make([]int, 0, 50)      // Max 25-level stack containing `l, r` pairs
-	stack = append(stack, 0)         // Push left index
-	stack = append(stack, len(xs)-1) // Push right index, inclusive
+// Writes Markdown tables with average numbers of comparisons and moves ShellSortWithGaps takes
+// with each of the gap sequences above to sort random arrays of lengths 2^4 to 2^pow.
+func ShellSortGapsReport(w io.Writer, buf []uint16, seed uint16, pow int, iters int) {
+	type row struct {
+		length             int
+		comparisons, moves []int
+	}
+	var rows []row
 
-	for len(stack) > 0 {
-		r := stack[len(stack)-1]     // Pop right index, inclusive
-		l := stack[len(stack)-2]     // Pop left
-		stack = stack[:len(stack)-2] // Fix stack length
+	for p := 4; p <= pow; p++ {
+		length := 1 << p
+		xs := buf[:length]
+		r := row{length, make([]int, len(shellSortGapSequences)), make([]int, len(shellSortGapSequences))}
+
+		// All sequences sort the same arrays
+		for s, seq := range shellSortGapSequences {
+			nextSeed := seed
+			gaps := seq.gaps(length)
+			comparisons, moves := 0, 0
+			for i := 0; i < iters; i++ {
+				nextSeed = FillUint16Array(xs, nextSeed)
+				moves += shellSortWithGapsImpl(xs, gaps, func(a, b uint16) int {
+					comparisons++
+					return cmp.Compare(a, b)
+				})
+			}
+			r.comparisons[s] = comparisons / iters
+			r.moves[s] = moves / iters
+		}
+		rows = append(rows, r)
+	}
 
-		if r <= l {
-			continue
+	for _, table := range []string{"comparisons", "moves"} {
+		fmt.Fprintf(w, "\nAverage %s:\n\n| n |", table)
+		for _, seq := range shellSortGapSequences {
+			fmt.Fprintf(w, " %s |", seq.name)
 		}
+		fmt.Fprintf(w, "\n|---:|%s\n", strings.Repeat("---:|", len(shellSortGapSequences)))
+		for _, r := range rows {
+			counts := r.comparisons
+			if table == "moves" {
+				counts = r.moves
+			}
+			fmt.Fprintf(w, "| %d |", r.length)
+			for _, c := range counts {
+				fmt.Fprintf(w, " %d |", c)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
 
-		// `r+1` because right border of a slice is not included
-		// `l+` because `Partition` returns an offset from `l`
-		i := l + Partition(xs[l:r+1])
+// Maximum length of slices sorted by the fixed sorting networks
+const sortingNetworkMaxLength = 16
+
+// Sorting networks for each length up to sortingNetworkMaxLength, one line per layer of independent comparators.
+// These are the smallest known networks, proven optimal in size for lengths up to 12.
+// Generated from Dobbelaere's list of smallest sorting networks, the one for 15 by removing the last input
+// of the one for 16, and verified on all 0-1 inputs.
+var sortingNetworks = [sortingNetworkMaxLength + 1][][2]uint8{
+	2: {
+		{0, 1},
+	},
+	3: {
+		{0, 2},
+		{0, 1},
+		{1, 2},
+	},
+	4: {
+		{0, 2}, {1, 3},
+		{0, 1}, {2, 3},
+		{1, 2},
+	},
+	5: {
+		{0, 3}, {1, 4},
+		{0, 2}, {1, 3},
+		{0, 1}, {2, 4},
+		{1, 2}, {3, 4},
+		{2, 3},
+	},
+	6: {
+		{0, 5}, {1, 3}, {2, 4},
+		{1, 2}, {3, 4},
+		{0, 3}, {2, 5},
+		{0, 1}, {2, 3}, {4, 5},
+		{1, 2}, {3, 4},
+	},
+	7: {
+		{0, 6}, {2, 3}, {4, 5},
+		{0, 2}, {1, 4}, {3, 6},
+		{0, 1}, {2, 5}, {3, 4},
+		{1, 2}, {4, 6},
+		{2, 3}, {4, 5},
+		{1, 2}, {3, 4}, {5, 6},
+	},
+	8: {
+		{0, 2}, {1, 3}, {4, 6}, {5, 7},
+		{0, 4}, {1, 5}, {2, 6}, {3, 7},
+		{0, 1}, {2, 3}, {4, 5}, {6, 7},
+		{2, 4}, {3, 5},
+		{1, 4}, {3, 6},
+		{1, 2}, {3, 4}, {5, 6},
+	},
+	9: {
+		{0, 3}, {1, 7}, {2, 5}, {4, 8},
+		{0, 7}, {2, 4}, {3, 8}, {5, 6},
+		{0, 2}, {1, 3}, {4, 5}, {7, 8},
+		{1, 4}, {3, 6}, {5, 7},
+		{0, 1}, {2, 4}, {3, 5}, {6, 8},
+		{2, 3}, {4, 5}, {6, 7},
+		{1, 2}, {3, 4}, {5, 6},
+	},
+	10: {
+		{0, 8}, {1, 9}, {2, 7}, {3, 5}, {4, 6},
+		{0, 2}, {1, 4}, {5, 8}, {7, 9},
+		{0, 3}, {2, 4}, {5, 7}, {6, 9},
+		{0, 1}, {3, 6}, {8, 9},
+		{1, 5}, {2, 3}, {4, 8}, {6, 7},
+		{1, 2}, {3, 5}, {4, 6}, {7, 8},
+		{2, 3}, {4, 5}, {6, 7},
+		{3, 4}, {5, 6},
+	},
+	11: {
+		{0, 9}, {1, 6}, {2, 4}, {3, 7}, {5, 8},
+		{0, 1}, {3, 5}, {4, 10}, {6, 9}, {7, 8},
+		{1, 3}, {2, 5}, {4, 7}, {8, 10},
+		{0, 4}, {1, 2}, {3, 7}, {5, 9}, {6, 8},
+		{0, 1}, {2, 6}, {4, 5}, {7, 8}, {9, 10},
+		{2, 4}, {3, 6}, {5, 7}, {8, 9},
+		{1, 2}, {3, 4}, {5, 6}, {7, 8},
+		{2, 3}, {4, 5}, {6, 7},
+	},
+	12: {
+		{0, 8}, {1, 7}, {2, 6}, {3, 11}, {4, 10}, {5, 9},
+		{0, 1}, {2, 5}, {3, 4}, {6, 9}, {7, 8}, {10, 11},
+		{0, 2}, {1, 6}, {5, 10}, {9, 11},
+		{0, 3}, {1, 2}, {4, 6}, {5, 7}, {8, 11}, {9, 10},
+		{1, 4}, {3, 5}, {6, 8}, {7, 10},
+		{1, 3}, {2, 5}, {6, 9}, {8, 10},
+		{2, 3}, {4, 5}, {6, 7}, {8, 9},
+		{4, 6}, {5, 7},
+		{3, 4}, {5, 6}, {7, 8},
+	},
+	13: {
+		{0, 12}, {1, 10}, {2, 9}, {3, 7}, {5, 11}, {6, 8},
+		{1, 6}, {2, 3}, {4, 11}, {7, 9}, {8, 10},
+		{0, 4}, {1, 2}, {3, 6}, {7, 8}, {9, 10}, {11, 12},
+		{4, 6}, {5, 9}, {8, 11}, {10, 12},
+		{0, 5}, {3, 8}, {4, 7}, {6, 11}, {9, 10},
+		{0, 1}, {2, 5}, {6, 9}, {7, 8}, {10, 11},
+		{1, 3}, {2, 4}, {5, 6}, {9, 10},
+		{1, 2}, {3, 4}, {5, 7}, {6, 8},
+		{2, 3}, {4, 5}, {6, 7}, {8, 9},
+		{3, 4}, {5, 6},
+	},
+	14: {
+		{0, 1}, {2, 3}, {4, 5}, {6, 7}, {8, 9}, {10, 11}, {12, 13},
+		{0, 2}, {1, 3}, {4, 8}, {5, 9}, {10, 12}, {11, 13},
+		{0, 4}, {1, 2}, {3, 7}, {5, 8}, {6, 10}, {9, 13}, {11, 12},
+		{0, 6}, {1, 5}, {3, 9}, {4, 10}, {7, 13}, {8, 12},
+		{2, 10}, {3, 11}, {4, 6}, {7, 9},
+		{1, 3}, {2, 8}, {5, 11}, {6, 7}, {10, 12},
+		{1, 4}, {2, 6}, {3, 5}, {7, 11}, {8, 10}, {9, 12},
+		{2, 4}, {3, 6}, {5, 8}, {7, 10}, {9, 11},
+		{3, 4}, {5, 6}, {7, 8}, {9, 10},
+		{6, 7},
+	},
+	15: {
+		{0, 13}, {1, 12}, {3, 14}, {4, 8}, {5, 6}, {7, 11}, {9, 10},
+		{0, 5}, {1, 7}, {2, 9}, {3, 4}, {6, 13}, {8, 14}, {11, 12},
+		{0, 1}, {2, 3}, {4, 5}, {6, 8}, {7, 9}, {10, 11}, {12, 13},
+		{0, 2}, {1, 3}, {4, 10}, {5, 11}, {6, 7}, {8, 9}, {12, 14},
+		{1, 2}, {3, 12}, {4, 6}, {5, 7}, {8, 10}, {9, 11}, {13, 14},
+		{1, 4}, {2, 6}, {5, 8}, {7, 10}, {9, 13}, {11, 14},
+		{2, 4}, {3, 6}, {9, 12}, {11, 13},
+		{3, 5}, {6, 8}, {7, 9}, {10, 12},
+		{3, 4}, {5, 6}, {7, 8}, {9, 10}, {11, 12},
+		{6, 7}, {8, 9},
+	},
+	16: {
+		{0, 13}, {1, 12}, {2, 15}, {3, 14}, {4, 8}, {5, 6}, {7, 11}, {9, 10},
+		{0, 5}, {1, 7}, {2, 9}, {3, 4}, {6, 13}, {8, 14}, {10, 15}, {11, 12},
+		{0, 1}, {2, 3}, {4, 5}, {6, 8}, {7, 9}, {10, 11}, {12, 13}, {14, 15},
+		{0, 2}, {1, 3}, {4, 10}, {5, 11}, {6, 7}, {8, 9}, {12, 14}, {13, 15},
+		{1, 2}, {3, 12}, {4, 6}, {5, 7}, {8, 10}, {9, 11}, {13, 14},
+		{1, 4}, {2, 6}, {5, 8}, {7, 10}, {9, 13}, {11, 14},
+		{2, 4}, {3, 6}, {9, 12}, {11, 13},
+		{3, 5}, {6, 8}, {7, 9}, {10, 12},
+		{3, 4}, {5, 6}, {7, 8}, {9, 10}, {11, 12},
+		{6, 7}, {8, 9},
+	},
+}
 
-		// Compare lengths of left (l,i-1) and right (i+1,r) parts
-		// to push the smallest part to the top to limit stack growth
-		if i-l > r-i { // Right part is smaller
-			stack = append(stack, l)   // Push left left
-			stack = append(stack, i-1) // Push left right
-			stack = append(stack, i+1) // Push right left
-			stack = append(stack, r)   // Push right right
-		} else { // Left part is smaller
-			stack = append(stack, i+1) // Push right left
-			stack = append(stack, r)   // Push right right
-			stack = append(stack, l)   // Push left left
-			stack = append(stack, i-1) // Push left right
+// Returns a compare-exchange of the sorting networks below that uses cmp
+func compareExchangeWith[T any](cmp func(a, b T) int) func(A, B *T) {
+	return func(A, B *T) { CompareExchangeFunc(A, B, cmp) }
+}
+
+// Applies comparators of network to xs using compareExchange.
+// Sorts in ascending order if asc and in descending order otherwise.
+func applySortingNetwork[T any](xs []T, network [][2]uint8, asc bool, compareExchange func(A, B *T)) {
+	for _, c := range network {
+		if asc {
+			compareExchange(&xs[c[0]], &xs[c[1]])
+		} else {
+			compareExchange(&xs[c[1]], &xs[c[0]])
 		}
 	}
 }
 
-const hybridQuickSortMinArrayLength = 10
+// Sorts slices up to sortingNetworkMaxLength long with fixed optimal sorting networks and longer ones with OddEvenMergeSort.
+// Makes the same comparisons in the same order for all inputs of the same length, though whether elements
+// are exchanged depends on the data, see NetworkSortInteger for a version that doesn't branch on it.
+// Not stable.
+func NetworkSort[T cmp.Ordered](xs []T) {
+	NetworkSortFunc(xs, cmp.Compare[T])
+}
 
-// Based on Sedgewick, Algorithms in C++, prog. 7.4.
-func medianOfThreeQuickSort[T cmp.Ordered](xs []T) {
-	// Skip small subarrays, they are sorted on the next step
-	ln := len(xs)
-	if ln <= hybridQuickSortMinArrayLength {
+func NetworkSortFunc[T any](xs []T, cmp func(a, b T) int) {
+	networkSortImpl(xs, compareExchangeWith(cmp))
+}
+
+// Same as NetworkSort, but uses CompareExchangeBranchless, so it doesn't branch on the values of elements
+// as long as the compiler keeps that code branchless. Go doesn't guarantee it, so check the generated code
+// before relying on this for secret data.
+func NetworkSortInteger[T Integer](xs []T) {
+	networkSortImpl(xs, CompareExchangeBranchless[T])
+}
+
+func networkSortImpl[T any](xs []T, compareExchange func(A, B *T)) {
+	if len(xs) <= sortingNetworkMaxLength {
+		applySortingNetwork(xs, sortingNetworks[len(xs)], true, compareExchange)
 		return
 	}
+	oddEvenMergeSortImpl(xs, compareExchange)
+}
 
-	// Median-of-three: compare three elements and move median to the first position
-	r := ln - 1
-	Exchange(&xs[r/2], &xs[r-1])
-	CompareExchange(&xs[0], &xs[r-1])
-	CompareExchange(&xs[0], &xs[r])
-	CompareExchange(&xs[r-1], &xs[r])
-
-	p := Partition(xs[1:ln])
-	QuickSort(xs[:p])
-	QuickSort(xs[p+1:])
+// Batcher's odd-even merge sort, see Sedgewick, Algorithms in C++, section 11.1.
+// Works for any length as if xs was padded up to a power of two with elements greater than all others.
+// Sorts blocks of sortingNetworkMaxLength elements with the fixed networks instead of the first merge passes.
+// The sequence of comparisons depends only on len(xs), but exchanges depend on the data,
+// see OddEvenMergeSortInteger for a version that doesn't branch on it. Takes O(n log^2 n) comparisons.
+// Not stable.
+func OddEvenMergeSort[T cmp.Ordered](xs []T) {
+	OddEvenMergeSortFunc(xs, cmp.Compare[T])
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 7.4.
-func HybridQuickSort[T cmp.Ordered](xs []T) {
-	medianOfThreeQuickSort(xs)
-	InsertionSort2(xs)
+func OddEvenMergeSortFunc[T any](xs []T, cmp func(a, b T) int) {
+	oddEvenMergeSortImpl(xs, compareExchangeWith(cmp))
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 7.5.
-func ThreeWayPartition[T cmp.Ordered](xs []T) (int, int) {
-	// TODO: implement
-	return 0, 0
+// Same as OddEvenMergeSort, but uses CompareExchangeBranchless, so it doesn't branch on the values of elements,
+// with the same caveat as NetworkSortInteger.
+func OddEvenMergeSortInteger[T Integer](xs []T) {
+	oddEvenMergeSortImpl(xs, CompareExchangeBranchless[T])
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 7.5.
-func ThreeWayQuickSort[T cmp.Ordered](xs []T) {
-	if len(xs) <= 1 {
-		return
+func oddEvenMergeSortImpl[T any](xs []T, compareExchange func(A, B *T)) {
+	n := len(xs)
+	for i := 0; i < n; i += sortingNetworkMaxLength {
+		b := xs[i:min(i+sortingNetworkMaxLength, n)]
+		applySortingNetwork(b, sortingNetworks[len(b)], true, compareExchange)
+	}
+
+	// Merges pairs of sorted blocks of length p, comparing elements k apart within each pair
+	for p := sortingNetworkMaxLength; p < n; p += p {
+		for k := p; k > 0; k /= 2 {
+			for j := k % p; j+k < n; j += k + k {
+				for i := 0; i < k && i+j+k < n; i++ {
+					if (i+j)/(p+p) == (i+j+k)/(p+p) {
+						compareExchange(&xs[i+j], &xs[i+j+k])
+					}
+				}
+			}
+		}
 	}
-	i, j := ThreeWayPartition(xs)
-	ThreeWayQuickSort(xs[:i])
-	ThreeWayQuickSort(xs[j:])
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 7.6.
-func Select[T cmp.Ordered](xs []T, k int) {
-	if len(xs) <= 1 {
+// Merges bitonic xs, that is ascending then descending or the other way around,
+// into ascending order if asc and descending order otherwise
+func bitonicMerge[T any](xs []T, asc bool, compareExchange func(A, B *T)) {
+	n := len(xs)
+	if n <= 1 {
 		return
 	}
 
-	p := Partition(xs)
-	if p > k {
-		Select(xs[:p], k)
-	}
-	if p < k {
-		Select(xs[p+1:], k-p-1)
+	// The greatest power of two less than n
+	m := 1 << (bits.Len(uint(n-1)) - 1)
+	for i := 0; i < n-m; i++ {
+		if asc {
+			compareExchange(&xs[i], &xs[i+m])
+		} else {
+			compareExchange(&xs[i+m], &xs[i])
+		}
 	}
+	bitonicMerge(xs[:m], asc, compareExchange)
+	bitonicMerge(xs[m:], asc, compareExchange)
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 7.7.
-func NonRecursiveSelect[T cmp.Ordered](xs []T, k int) {
-	l, r := 0, len(xs)
-	for r > l+1 {
-		p := l + Partition(xs[l:r])
-		if p >= k {
-			r = p
-		}
-		if p <= k {
-			l = p + 1
-		}
+func bitonicSortImpl[T any](xs []T, asc bool, compareExchange func(A, B *T)) {
+	n := len(xs)
+	if n <= sortingNetworkMaxLength {
+		applySortingNetwork(xs, sortingNetworks[n], asc, compareExchange)
+		return
 	}
+
+	// Sorting halves in opposite directions makes xs bitonic
+	m := n / 2
+	bitonicSortImpl(xs[:m], !asc, compareExchange)
+	bitonicSortImpl(xs[m:], asc, compareExchange)
+	bitonicMerge(xs, asc, compareExchange)
 }
 
-func Assert(flag bool, msg string) {
-	if !flag {
-		_, file, line, _ := runtime.Caller(1)
-		fmt.Fprintf(os.Stderr, "%s at %s:%d\n", msg, file, line)
-		os.Exit(1)
-	}
+// Batcher's bitonic sort generalized to any length, based on Lang, Bitonic sorting network for n not a power of 2.
+// Sorts blocks of at most sortingNetworkMaxLength elements with the fixed networks.
+// The sequence of comparisons depends only on len(xs), but exchanges depend on the data,
+// see BitonicSortInteger for a version that doesn't branch on it. Takes O(n log^2 n) comparisons.
+// Not stable.
+func BitonicSort[T cmp.Ordered](xs []T) {
+	BitonicSortFunc(xs, cmp.Compare[T])
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 8.1.
-// Assumes out, xs, and ys do not intersect!
-// TODO: write a test
-func MergeInto[T cmp.Ordered](out []T, xs []T, ys []T) {
-	N, M := len(xs), len(ys)
+func BitonicSortFunc[T any](xs []T, cmp func(a, b T) int) {
+	bitonicSortImpl(xs, true, compareExchangeWith(cmp))
+}
 
-	Assert(len(out) >= N+M, "out array is smaller than sum of lengths of input arrays")
-	Assert(IsSorted(xs), "xs is not sorted")
-	Assert(IsSorted(ys), "ys is not sorted")
+// Same as BitonicSort, but uses CompareExchangeBranchless, so it doesn't branch on the values of elements,
+// with the same caveat as NetworkSortInteger.
+func BitonicSortInteger[T Integer](xs []T) {
+	bitonicSortImpl(xs, true, CompareExchangeBranchless[T])
+}
 
-	for i, j, k := 0, 0, 0; k < N+M; k++ {
-		if i == N {
-			out[k] = ys[j]
-			j++
-			continue
-		}
+// From golang.org/x/exp/constraints package
 
-		if j == M {
-			out[k] = xs[i]
+type Signed interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64
+}
+
+type Unsigned interface {
+	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+type Integer interface {
+	Signed | Unsigned
+}
+
+// Key ranges larger than this are not counted, CountSort falls back to a comparison sort
+const countSortMaxKeyRange = 1 << 20
+
+// Based on Sedgewick, Algorithms in C++, prog. 6.17.
+// Keys are offset by the minimal element, so signed types and ranges not starting at zero are supported.
+// Stable, but falls back to ShellSort which is not.
+func CountSort[T Integer](xs []T) {
+	if len(xs) <= 1 {
+		return
+	}
+
+	// Find the range of keys
+	lo, hi := xs[0], xs[0]
+	for _, x := range xs[1:] {
+		lo = min(lo, x)
+		hi = max(hi, x)
+	}
+
+	// Subtract in uint64, so that the range of a signed type doesn't overflow
+	m := uint64(hi) - uint64(lo)
+	if m >= countSortMaxKeyRange {
+		ShellSort(xs)
+		return
+	}
+
+	// Count occurrences of each key, shifted by one position
+	cnt := make([]int, m+2)
+	for _, x := range xs {
+		cnt[uint64(x)-uint64(lo)+1]++
+	}
+
+	// Turn counts into the starting position of each key
+	for k := 1; k < len(cnt); k++ {
+		cnt[k] += cnt[k-1]
+	}
+
+	// Distribute elements into their positions in the buffer
+	b := make([]T, len(xs))
+	for _, x := range xs {
+		k := uint64(x) - uint64(lo)
+		b[cnt[k]] = x
+		cnt[k]++
+	}
+
+	copy(xs, b)
+	statsMoves(2 * len(xs))
+}
+
+// Distributes elements into buckets of equal key ranges, sorts each bucket with inner and concatenates the buckets.
+// If buckets <= 0, uses one bucket per element, but no more buckets than there are distinct keys in the range.
+// If inner is nil, uses PdqSort, which sorts small buckets with insertion sort, but doesn't become quadratic
+// when skewed keys put most elements into a few buckets.
+// Stable if inner is stable.
+func BucketSortWith[T Integer](xs []T, buckets int, inner func(xs []T)) {
+	if inner == nil {
+		inner = PdqSort[T]
+	}
+	if len(xs) <= 1 {
+		return
+	}
+
+	// Find the range of keys
+	lo, hi := xs[0], xs[0]
+	for _, x := range xs[1:] {
+		lo = min(lo, x)
+		hi = max(hi, x)
+	}
+
+	// Subtract in uint64, so that the range of a signed type doesn't overflow
+	d := uint64(hi) - uint64(lo)
+	if buckets <= 0 {
+		buckets = len(xs)
+		if d < uint64(buckets) {
+			buckets = int(d) + 1
+		}
+	}
+	if buckets == 1 {
+		inner(xs)
+		return
+	}
+
+	// Each bucket covers `width` keys, the last one may cover less.
+	// `d/width < buckets` because `buckets*(d/buckets+1) > d`.
+	width := d/uint64(buckets) + 1
+	bucket := func(x T) uint64 { return (uint64(x) - uint64(lo)) / width }
+
+	// Count elements in each bucket, shifted by one position, and turn counts into starting positions
+	cnt := make([]int, buckets+1)
+	for _, x := range xs {
+		cnt[bucket(x)+1]++
+	}
+	for k := 1; k < len(cnt); k++ {
+		cnt[k] += cnt[k-1]
+	}
+
+	// Distribute elements into their buckets in the buffer.
+	// Advancing cnt[k] moves it to the start of the next bucket, so cnt[k-1]:cnt[k] is bucket k afterwards.
+	b := make([]T, len(xs))
+	for _, x := range xs {
+		k := bucket(x)
+		b[cnt[k]] = x
+		cnt[k]++
+	}
+
+	// Sort each bucket, buckets are already ordered relative to each other
+	for k, l := 0, 0; k < buckets; k++ {
+		inner(b[l:cnt[k]])
+		l = cnt[k]
+	}
+
+	copy(xs, b)
+	statsMoves(2 * len(xs))
+}
+
+// Uses BucketSortWith with the default bucket count and inner sort.
+func BucketSort[T Integer](xs []T) {
+	BucketSortWith(xs, 0, nil)
+}
+
+// Returns the number of bytes in T
+func radixSortBytes[T Integer]() int {
+	var zero T
+	return int(unsafe.Sizeof(zero))
+}
+
+// Returns the mask applied to the d-th byte of a key.
+// The sign bit of the most significant byte of a signed type is flipped, so that negative numbers go first.
+func radixSortFlip[T Integer](d int) int {
+	var zero T
+	if ^zero < 0 && d == radixSortBytes[T]()-1 {
+		return 0x80
+	}
+	return 0
+}
+
+// Returns the d-th byte of x, counting from the least significant one
+func radixSortByte[T Integer](x T, d int, flip int) int {
+	return int(uint64(x)>>(8*d)&0xFF) ^ flip
+}
+
+// Sorts byte by byte starting from the least significant one using key-indexed counting, which is stable.
+// Elements are distributed between xs and aux on each pass, so aux must be at least as long as xs.
+// Panics if aux is shorter than xs, see LSDRadixSortChecked.
+func LSDRadixSort[T Integer](xs []T, aux []T) {
+	if err := checkAux(xs, aux); err != nil {
+		panic(err)
+	}
+	aux = aux[:len(xs)]
+	if len(xs) <= 1 {
+		return
+	}
+
+	src, dst := xs, aux
+	for d := 0; d < radixSortBytes[T](); d++ {
+		flip := radixSortFlip[T](d)
+
+		// Count occurrences of each byte, shifted by one position
+		var cnt [257]int
+		for _, x := range src {
+			cnt[radixSortByte(x, d, flip)+1]++
+		}
+
+		// Skip the pass if all elements have the same byte
+		if cnt[radixSortByte(src[0], d, flip)+1] == len(src) {
+			continue
+		}
+
+		// Turn counts into the starting position of each byte
+		for b := 1; b < len(cnt); b++ {
+			cnt[b] += cnt[b-1]
+		}
+
+		// Distribute elements into their positions in the other array
+		for _, x := range src {
+			b := radixSortByte(x, d, flip)
+			dst[cnt[b]] = x
+			cnt[b]++
+		}
+		statsMoves(len(src))
+
+		src, dst = dst, src
+	}
+
+	// After an odd number of passes the result is in aux
+	if &src[0] != &xs[0] {
+		copy(xs, src)
+		statsMoves(len(xs))
+	}
+}
+
+// Same as LSDRadixSort, but returns an error instead of sorting if aux is too small.
+func LSDRadixSortChecked[T Integer](xs []T, aux []T) error {
+	if err := checkAux(xs, aux); err != nil {
+		return err
+	}
+	LSDRadixSort(xs, aux)
+	return nil
+}
+
+// Subarrays of this length or smaller are sorted using InsertionSort2
+const msdRadixSortMinArrayLength = 32
+
+// American flag sort: in-place MSD radix sort.
+// See McIlroy, Bostic, McIlroy, Engineering Radix Sort.
+func msdRadixSortImpl[T Integer](xs []T, d int) {
+	if len(xs) <= msdRadixSortMinArrayLength {
+		InsertionSort2(xs)
+		return
+	}
+
+	flip := radixSortFlip[T](d)
+
+	// Count occurrences of each byte
+	var cnt [256]int
+	for _, x := range xs {
+		cnt[radixSortByte(x, d, flip)]++
+	}
+
+	// Find borders of each bucket: head is the next unsorted position, tail is the end
+	var head, tail [256]int
+	for b, l := 0, 0; b < 256; b++ {
+		head[b] = l
+		l += cnt[b]
+		tail[b] = l
+	}
+
+	// Permute elements in cycles: take the first unsorted element of a bucket,
+	// put it into the bucket it belongs to, then continue with the element displaced from there
+	for b := 0; b < 256; b++ {
+		for head[b] < tail[b] {
+			v := xs[head[b]]
+			for k := radixSortByte(v, d, flip); k != b; k = radixSortByte(v, d, flip) {
+				Exchange(&v, &xs[head[k]])
+				head[k]++
+			}
+			xs[head[b]] = v
+			statsMoves(1)
+			head[b]++
+		}
+	}
+
+	if d == 0 {
+		return
+	}
+
+	// Sort each bucket by the next byte
+	for b, l := 0, 0; b < 256; b++ {
+		msdRadixSortImpl(xs[l:l+cnt[b]], d-1)
+		l += cnt[b]
+	}
+}
+
+// Sorts byte by byte starting from the most significant one in place.
+// Not stable.
+func MSDRadixSort[T Integer](xs []T) {
+	msdRadixSortImpl(xs, radixSortBytes[T]()-1)
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 7.2.
+// Unlike the original, steps over the exchanged elements, which otherwise swaps two elements equal to the pivot forever.
+func Partition[T cmp.Ordered](xs []T) int {
+	return PartitionFunc(xs, cmp.Compare[T])
+}
+
+func PartitionFunc[T any](xs []T, cmp func(a, b T) int) int {
+	i, j, v := 0, len(xs)-2, xs[len(xs)-1]
+
+	for {
+		for i < len(xs) && cmp(xs[i], v) < 0 {
+			i++
+		}
+		// xs[i] is the first element that is >= v
+
+		for j >= 0 && cmp(v, xs[j]) < 0 {
+			j--
+			if j == 0 {
+				break
+			}
+		}
+		// xs[j] is the first element that is <= v
+
+		if i >= j {
+			break
+		}
+
+		Exchange(&xs[i], &xs[j])
+
+		// Step over the exchanged elements, otherwise elements equal to v are exchanged forever
+		i++
+		j--
+	}
+
+	Exchange(&xs[i], &xs[len(xs)-1])
+	return i
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 7.1.
+// Not stable.
+func QuickSort[T cmp.Ordered](xs []T) {
+	QuickSortFunc(xs, cmp.Compare[T])
+}
+
+func QuickSortFunc[T any](xs []T, cmp func(a, b T) int) {
+	statsEnter()
+	defer statsLeave()
+
+	if len(xs) <= 1 {
+		return
+	}
+
+	p := PartitionFunc(xs, cmp)
+	QuickSortFunc(xs[:p], cmp)
+	QuickSortFunc(xs[p+1:], cmp)
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 7.3.
+// Not stable.
+func NonRecursiveQuickSort[T cmp.Ordered](xs []T) {
+	NonRecursiveQuickSortFunc(xs, cmp.Compare[T])
+}
+
+func NonRecursiveQuickSortFunc[T any](xs []T, cmp func(a, b T) int) {
+	stack := make([]int, 0, 50)      // Max 25-level stack containing `l, r` pairs
+	stack = append(stack, 0)         // Push left index
+	stack = append(stack, len(xs)-1) // Push right index, inclusive
+
+	for len(stack) > 0 {
+		r := stack[len(stack)-1]     // Pop right index, inclusive
+		l := stack[len(stack)-2]     // Pop left
+		stack = stack[:len(stack)-2] // Fix stack length
+
+		if r <= l {
+			continue
+		}
+
+		// `r+1` because right border of a slice is not included
+		// `l+` because `Partition` returns an offset from `l`
+		i := l + PartitionFunc(xs[l:r+1], cmp)
+
+		// Compare lengths of left (l,i-1) and right (i+1,r) parts
+		// to push the smallest part to the top to limit stack growth
+		if i-l > r-i { // Right part is smaller
+			stack = append(stack, l)   // Push left left
+			stack = append(stack, i-1) // Push left right
+			stack = append(stack, i+1) // Push right left
+			stack = append(stack, r)   // Push right right
+		} else { // Left part is smaller
+			stack = append(stack, i+1) // Push right left
+			stack = append(stack, r)   // Push right right
+			stack = append(stack, l)   // Push left left
+			stack = append(stack, i-1) // Push left right
+		}
+	}
+}
+
+const hybridQuickSortMinArrayLength = 10
+
+// Based on Sedgewick, Algorithms in C++, prog. 7.4.
+// Partitions xs around the median of its first, middle and last elements. Requires len(xs) >= 3.
+func medianOfThreePartition[T any](xs []T, cmp func(a, b T) int) int {
+	// Median-of-three: compare three elements and move the median to the position before the last,
+	// the first and the last elements become sentinels for partitioning
+	r := len(xs) - 1
+	Exchange(&xs[r/2], &xs[r-1])
+	CompareExchangeFunc(&xs[0], &xs[r-1], cmp)
+	CompareExchangeFunc(&xs[0], &xs[r], cmp)
+	CompareExchangeFunc(&xs[r-1], &xs[r], cmp)
+
+	// `1+` because `Partition` returns an offset from 1
+	return 1 + PartitionFunc(xs[1:r], cmp)
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 7.4.
+// Switches to HeapSort when depth reaches zero, so that bad pivots can't make it quadratic (Musser's introsort).
+func medianOfThreeQuickSort[T any](xs []T, depth int, cmp func(a, b T) int) {
+	statsEnter()
+	defer statsLeave()
+
+	// Skip small subarrays, they are sorted on the next step
+	ln := len(xs)
+	if ln <= hybridQuickSortMinArrayLength {
+		return
+	}
+
+	if depth == 0 {
+		HeapSortFunc(xs, cmp)
+		return
+	}
+
+	p := medianOfThreePartition(xs, cmp)
+	medianOfThreeQuickSort(xs[:p], depth-1, cmp)
+	medianOfThreeQuickSort(xs[p+1:], depth-1, cmp)
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 7.4.
+// Recursion depth is limited by 2*log2(n), see medianOfThreeQuickSort.
+// Not stable.
+func HybridQuickSort[T cmp.Ordered](xs []T) {
+	HybridQuickSortFunc(xs, cmp.Compare[T])
+}
+
+func HybridQuickSortFunc[T any](xs []T, cmp func(a, b T) int) {
+	medianOfThreeQuickSort(xs, 2*(bits.Len(uint(len(xs)))-1), cmp)
+	InsertionSort2Func(xs, cmp)
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 7.5.
+// Bentley-McIlroy partitioning using the last element as the partitioning one.
+// Returns the `[lt, gt)` range of elements equal to it: xs[:lt] are less and xs[gt:] are greater.
+func ThreeWayPartition[T cmp.Ordered](xs []T) (int, int) {
+	return ThreeWayPartitionFunc(xs, cmp.Compare[T])
+}
+
+func ThreeWayPartitionFunc[T any](xs []T, cmp func(a, b T) int) (int, int) {
+	if len(xs) <= 1 {
+		return 0, len(xs)
+	}
+
+	r := len(xs) - 1
+	v := xs[r]
+
+	// xs[:p+1] and xs[q:r] collect elements equal to v while partitioning
+	i, j, p, q := -1, r, -1, r
+
+	for {
+		// The partitioning element at xs[r] stops the scan
+		i++
+		for cmp(xs[i], v) < 0 {
+			i++
+		}
+		// xs[i] is the first element that is >= v
+
+		j--
+		for cmp(v, xs[j]) < 0 {
+			if j == 0 {
+				break
+			}
+			j--
+		}
+		// xs[j] is the first element that is <= v
+
+		if i >= j {
+			break
+		}
+
+		Exchange(&xs[i], &xs[j])
+
+		// Move elements equal to v to the borders of the array
+		if cmp(xs[i], v) == 0 {
+			p++
+			Exchange(&xs[p], &xs[i])
+		}
+		if cmp(v, xs[j]) == 0 {
+			q--
+			Exchange(&xs[q], &xs[j])
+		}
+	}
+
+	// If both scans stopped at the same element equal to v,
+	// it gets exchanged with xs[r] and must be moved to the middle too
+	e := r - 1
+	if i == j && cmp(xs[i], v) == 0 {
+		e = r
+	}
+
+	// Place the partitioning element, xs[i] is the first element that is >= v
+	Exchange(&xs[i], &xs[r])
+	j, i = i-1, i+1
+
+	// Move equal elements from the borders to the middle
+	for k := 0; k <= p; k, j = k+1, j-1 {
+		Exchange(&xs[k], &xs[j])
+	}
+	for k := e; k >= q; k, i = k-1, i+1 {
+		Exchange(&xs[k], &xs[i])
+	}
+
+	return j + 1, i
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 7.5.
+// Not stable.
+func ThreeWayQuickSort[T cmp.Ordered](xs []T) {
+	ThreeWayQuickSortFunc(xs, cmp.Compare[T])
+}
+
+func ThreeWayQuickSortFunc[T any](xs []T, cmp func(a, b T) int) {
+	statsEnter()
+	defer statsLeave()
+
+	if len(xs) <= 1 {
+		return
+	}
+	i, j := ThreeWayPartitionFunc(xs, cmp)
+	ThreeWayQuickSortFunc(xs[:i], cmp)
+	ThreeWayQuickSortFunc(xs[j:], cmp)
+}
+
+// Subarrays smaller than this are sorted using InsertionSort2
+const pdqSortInsertionSortThreshold = 24
+
+// Subarrays larger than this use Tukey's ninther instead of median-of-three
+const pdqSortNintherThreshold = 128
+
+// Maximal number of moves partialInsertionSort does before giving up
+const pdqSortPartialInsertionSortLimit = 8
+
+// Number of elements scanned at once by pdqPartitionRight, must fit into uint8
+const pdqSortBlockSize = 64
+
+// Converts a bool into 0 or 1 without branching
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Sorts xs[a], xs[b], xs[c] in place
+func pdqSort3[T any](xs []T, a, b, c int, cmp func(a, b T) int) {
+	CompareExchangeFunc(&xs[a], &xs[b], cmp)
+	CompareExchangeFunc(&xs[b], &xs[c], cmp)
+	CompareExchangeFunc(&xs[a], &xs[b], cmp)
+}
+
+// Insertion sort that gives up after pdqSortPartialInsertionSortLimit moves.
+// Returns whether xs is sorted.
+func pdqPartialInsertionSort[T any](xs []T, cmp func(a, b T) int) bool {
+	limit := 0
+	for i := 1; i < len(xs); i++ {
+		if cmp(xs[i], xs[i-1]) < 0 {
+			j, v := i, xs[i]
+			for j > 0 && cmp(v, xs[j-1]) < 0 {
+				xs[j] = xs[j-1]
+				j--
+			}
+			xs[j] = v
+			statsMoves(i - j + 1)
+			limit += i - j
+		}
+		if limit > pdqSortPartialInsertionSortLimit {
+			return false
+		}
+	}
+	return true
+}
+
+// Partitions xs around xs[0] into elements less than or equal to it and elements greater than it.
+// Used when the predecessor of xs is equal to xs[0], so that all elements equal to it are skipped at once.
+// Returns the final position of the partitioning element.
+func pdqPartitionLeft[T any](xs []T, cmp func(a, b T) int) int {
+	v := xs[0]
+	i, j := 0, len(xs)
+
+	// Find the last element less than or equal to v, xs[0] stops the scan
+	j--
+	for cmp(v, xs[j]) < 0 {
+		j--
+	}
+
+	// Find the first element greater than v, guard the scan if there is no element after xs[j]
+	i++
+	if j+1 == len(xs) {
+		for i < j && cmp(v, xs[i]) >= 0 {
+			i++
+		}
+	} else {
+		for cmp(v, xs[i]) >= 0 {
+			i++
+		}
+	}
+
+	for i < j {
+		Exchange(&xs[i], &xs[j])
+		j--
+		for cmp(v, xs[j]) < 0 {
+			j--
+		}
+		i++
+		for cmp(v, xs[i]) >= 0 {
+			i++
+		}
+	}
+
+	xs[0], xs[j] = xs[j], v
+	statsMoves(2)
+	return j
+}
+
+// Partitions xs around xs[0] into elements less than it and elements greater than or equal to it.
+// Requires an element greater than or equal to xs[0] to be present after it.
+// Returns the final position of the partitioning element and whether xs was already partitioned.
+//
+// Block partitioning from Edelkamp, Weiss, BlockQuicksort: How Branch Mispredictions don't affect Quicksort.
+// Positions of misplaced elements are collected into offset buffers without branching on comparison results,
+// then elements are exchanged in pairs.
+func pdqPartitionRight[T any](xs []T, cmp func(a, b T) int) (int, bool) {
+	v := xs[0]
+	first, last := 0, len(xs)
+
+	// Find the first element greater than or equal to v
+	first++
+	for cmp(xs[first], v) < 0 {
+		first++
+	}
+
+	// Find the last element less than v, guard the scan if there is no element less than v before xs[first]
+	last--
+	if first == 1 {
+		for first < last && cmp(xs[last], v) >= 0 {
+			last--
+		}
+	} else {
+		for cmp(xs[last], v) >= 0 {
+			last--
+		}
+	}
+
+	// If both scans stopped at the same place, xs is already partitioned
+	partitioned := first >= last
+	if !partitioned {
+		Exchange(&xs[first], &xs[last])
+		first++
+
+		// Offsets of misplaced elements from baseL forwards and from baseR backwards
+		var offsetsL, offsetsR [pdqSortBlockSize]uint8
+		baseL, baseR := first, last
+		numL, numR, startL, startR := 0, 0, 0, 0
+
+		for first < last {
+			// Split unscanned elements between blocks that are empty
+			unknown := last - first
+			splitL, splitR := 0, 0
+			if numL == 0 {
+				splitL = unknown
+				if numR == 0 {
+					splitL = unknown / 2
+				}
+			}
+			if numR == 0 {
+				splitR = unknown - splitL
+			}
+
+			// Record positions of elements greater than or equal to v on the left
+			for i := 0; i < min(splitL, pdqSortBlockSize); i++ {
+				offsetsL[numL] = uint8(i)
+				numL += b2i(cmp(xs[first], v) >= 0)
+				first++
+			}
+
+			// Record positions of elements less than v on the right
+			for i := 1; i <= min(splitR, pdqSortBlockSize); i++ {
+				last--
+				offsetsR[numR] = uint8(i)
+				numR += b2i(cmp(xs[last], v) < 0)
+			}
+
+			// Exchange misplaced pairs
+			num := min(numL, numR)
+			for k := 0; k < num; k++ {
+				Exchange(&xs[baseL+int(offsetsL[startL+k])], &xs[baseR-int(offsetsR[startR+k])])
+			}
+			numL, numR = numL-num, numR-num
+			startL, startR = startL+num, startR+num
+
+			// Start a new block when one is exhausted
+			if numL == 0 {
+				startL, baseL = 0, first
+			}
+			if numR == 0 {
+				startR, baseR = 0, last
+			}
+		}
+
+		// All elements are scanned, move the remaining misplaced elements of one block to the border
+		if numL > 0 {
+			for numL > 0 {
+				numL--
+				last--
+				Exchange(&xs[baseL+int(offsetsL[startL+numL])], &xs[last])
+			}
+			first = last
+		}
+		for numR > 0 {
+			numR--
+			Exchange(&xs[baseR-int(offsetsR[startR+numR])], &xs[first])
+			first++
+		}
+	}
+
+	// Place the partitioning element
+	p := first - 1
+	xs[0], xs[p] = xs[p], v
+	statsMoves(2)
+	return p, partitioned
+}
+
+// Sorts xs[a:b]. Elements before a are less than or equal to elements of xs[a:b] unless leftmost is set.
+// badAllowed is the number of highly unbalanced partitions allowed before falling back to HeapSort.
+func pdqSortImpl[T any](xs []T, a, b int, badAllowed int, leftmost bool, cmp func(a, b T) int) {
+	statsEnter()
+	defer statsLeave()
+
+	for {
+		n := b - a
+		if n < pdqSortInsertionSortThreshold {
+			InsertionSort2Func(xs[a:b], cmp)
+			return
+		}
+
+		// Choose the pivot and move it to xs[a]
+		m := a + n/2
+		if n > pdqSortNintherThreshold {
+			pdqSort3(xs, a, m, b-1, cmp)
+			pdqSort3(xs, a+1, m-1, b-2, cmp)
+			pdqSort3(xs, a+2, m+1, b-3, cmp)
+			pdqSort3(xs, m-1, m, m+1, cmp)
+			Exchange(&xs[a], &xs[m])
+		} else {
+			pdqSort3(xs, m, a, b-1, cmp)
+		}
+
+		// The predecessor is less than or equal to all elements of xs[a:b].
+		// If it is equal to the pivot, there are many equal elements: put them to the left and skip them.
+		if !leftmost && cmp(xs[a-1], xs[a]) >= 0 {
+			a += pdqPartitionLeft(xs[a:b], cmp) + 1
+			continue
+		}
+
+		p, partitioned := pdqPartitionRight(xs[a:b], cmp)
+		p += a
+		l, r := p-a, b-p-1
+
+		if l < n/8 || r < n/8 {
+			// Highly unbalanced partition, likely a pattern in the input
+			badAllowed--
+			if badAllowed == 0 {
+				HeapSortFunc(xs[a:b], cmp)
+				return
+			}
+
+			// Break patterns by exchanging some elements
+			if l >= pdqSortInsertionSortThreshold {
+				Exchange(&xs[a], &xs[a+l/4])
+				Exchange(&xs[p-1], &xs[p-l/4])
+				if l > pdqSortNintherThreshold {
+					Exchange(&xs[a+1], &xs[a+l/4+1])
+					Exchange(&xs[a+2], &xs[a+l/4+2])
+					Exchange(&xs[p-2], &xs[p-l/4-1])
+					Exchange(&xs[p-3], &xs[p-l/4-2])
+				}
+			}
+			if r >= pdqSortInsertionSortThreshold {
+				Exchange(&xs[p+1], &xs[p+1+r/4])
+				Exchange(&xs[b-1], &xs[b-r/4])
+				if r > pdqSortNintherThreshold {
+					Exchange(&xs[p+2], &xs[p+2+r/4])
+					Exchange(&xs[p+3], &xs[p+3+r/4])
+					Exchange(&xs[b-2], &xs[b-1-r/4])
+					Exchange(&xs[b-3], &xs[b-2-r/4])
+				}
+			}
+		} else if partitioned && pdqPartialInsertionSort(xs[a:p], cmp) && pdqPartialInsertionSort(xs[p+1:b], cmp) {
+			// The partition was balanced and no elements were exchanged, likely the input is already sorted
+			return
+		}
+
+		// Recurse into the left part and loop over the right one
+		pdqSortImpl(xs, a, p, badAllowed, leftmost, cmp)
+		a, leftmost = p+1, false
+	}
+}
+
+// Pattern-defeating quicksort.
+// See Peters, Pattern-defeating Quicksort, https://github.com/orlp/pdqsort.
+// Not stable.
+func PdqSort[T cmp.Ordered](xs []T) {
+	PdqSortFunc(xs, cmp.Compare[T])
+}
+
+func PdqSortFunc[T any](xs []T, cmp func(a, b T) int) {
+	pdqSortImpl(xs, 0, len(xs), bits.Len(uint(len(xs))), true, cmp)
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 7.6.
+func Select[T cmp.Ordered](xs []T, k int) {
+	SelectFunc(xs, k, cmp.Compare[T])
+}
+
+func SelectFunc[T any](xs []T, k int, cmp func(a, b T) int) {
+	statsEnter()
+	defer statsLeave()
+
+	if len(xs) <= 1 {
+		return
+	}
+
+	p := PartitionFunc(xs, cmp)
+	if p > k {
+		SelectFunc(xs[:p], k, cmp)
+	}
+	if p < k {
+		SelectFunc(xs[p+1:], k-p-1, cmp)
+	}
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 7.7.
+func NonRecursiveSelect[T cmp.Ordered](xs []T, k int) {
+	NonRecursiveSelectFunc(xs, k, cmp.Compare[T])
+}
+
+func NonRecursiveSelectFunc[T any](xs []T, k int, cmp func(a, b T) int) {
+	l, r := 0, len(xs)
+	for r > l+1 {
+		p := l + PartitionFunc(xs[l:r], cmp)
+		if p >= k {
+			r = p
+		}
+		if p <= k {
+			l = p + 1
+		}
+	}
+}
+
+// Elements are split into groups of this size, medians of which are used to find a pivot in MedianOfMediansSelect
+const medianOfMediansGroupSize = 5
+
+// Subarrays up to this length are sorted by MedianOfMediansSelect instead of partitioning
+const medianOfMediansMinArrayLength = 10
+
+// Moves medians of groups of medianOfMediansGroupSize elements to the beginning of xs,
+// selects the median of them recursively and returns its index
+func medianOfMediansPivot[T any](xs []T, cmp func(a, b T) int) int {
+	m := 0
+	for l := 0; l < len(xs); l += medianOfMediansGroupSize {
+		g := xs[l:min(l+medianOfMediansGroupSize, len(xs))]
+		NetworkSortFunc(g, cmp)
+		Exchange(&xs[m], &g[len(g)/2])
+		m++
+	}
+	MedianOfMediansSelectFunc(xs[:m], m/2, cmp)
+	return m / 2
+}
+
+// Based on Blum, Floyd, Pratt, Rivest, Tarjan, Time bounds for selection, 1973 (BFPRT).
+// Partitions around the median of medians of groups of 5, which has at least 3/10 of elements on each side,
+// so it takes O(n) time in the worst case. It's slower than Select on average though.
+// Like Select, places the k-th smallest element at xs[k], smaller or equal elements before it and greater or equal after.
+func MedianOfMediansSelect[T cmp.Ordered](xs []T, k int) {
+	MedianOfMediansSelectFunc(xs, k, cmp.Compare[T])
+}
+
+func MedianOfMediansSelectFunc[T any](xs []T, k int, cmp func(a, b T) int) {
+	for len(xs) > medianOfMediansMinArrayLength {
+		p := medianOfMediansPivot(xs, cmp)
+
+		// Three-way partitioning, so that equal elements don't unbalance the parts
+		Exchange(&xs[p], &xs[len(xs)-1])
+		lt, gt := ThreeWayPartitionFunc(xs, cmp)
+		if k < lt {
+			xs = xs[:lt]
+		} else if k >= gt {
+			xs, k = xs[gt:], k-gt
+		} else {
+			return
+		}
+	}
+	InsertionSort2Func(xs, cmp)
+}
+
+// Subarrays longer than this are narrowed down by FloydRivestSelect by selecting from a sample first
+const floydRivestSampleMinArrayLength = 600
+
+// Based on Floyd, Rivest, Algorithm 489: The algorithm SELECT, 1975.
+// Recursively selects from a sample two elements that likely surround the k-th one in a narrow range
+// and partitions around them, so it takes about n + min(k, n-k) comparisons on average.
+// Like Select, places the k-th smallest element at xs[k], smaller or equal elements before it and greater or equal after.
+func FloydRivestSelect[T cmp.Ordered](xs []T, k int) {
+	FloydRivestSelectFunc(xs, k, cmp.Compare[T])
+}
+
+func FloydRivestSelectFunc[T any](xs []T, k int, cmp func(a, b T) int) {
+	floydRivestSelectImpl(xs, 0, len(xs)-1, k, cmp)
+}
+
+// Selects the k-th element within xs[l:r+1]
+func floydRivestSelectImpl[T any](xs []T, l, r, k int, cmp func(a, b T) int) {
+	for r > l {
+		if r-l > floydRivestSampleMinArrayLength {
+			// Sample size s and the distance sd of the sample around k grow as n^(2/3) and n^(1/3)*log(n)
+			n := float64(r - l + 1)
+			i := float64(k - l + 1)
+			z := math.Log(n)
+			s := 0.5 * math.Exp(2*z/3)
+			sd := 0.5 * math.Sqrt(z*s*(n-s)/n)
+			if i < n/2 {
+				sd = -sd
+			}
+			newL := max(l, int(float64(k)-i*s/n+sd))
+			newR := min(r, int(float64(k)+(n-i)*s/n+sd))
+			floydRivestSelectImpl(xs, newL, newR, k, cmp)
+		}
+
+		// Partition xs[l:r+1] around t = xs[k], which is placed at l or r as a sentinel
+		t := xs[k]
+		i, j := l, r
+		Exchange(&xs[l], &xs[k])
+		if cmp(xs[r], t) > 0 {
+			Exchange(&xs[r], &xs[l])
+		}
+		for i < j {
+			Exchange(&xs[i], &xs[j])
+			i++
+			j--
+			for cmp(xs[i], t) < 0 {
+				i++
+			}
+			for cmp(xs[j], t) > 0 {
+				j--
+			}
+		}
+		if cmp(xs[l], t) == 0 {
+			Exchange(&xs[l], &xs[j])
+		} else {
+			j++
+			Exchange(&xs[j], &xs[r])
+		}
+
+		// Now t is at j
+		if j <= k {
+			l = j + 1
+		}
+		if k <= j {
+			r = j - 1
+		}
+	}
+}
+
+// Based on Musser, Introspective sorting and selection algorithms, 1997.
+// Quickselect with median-of-three partitioning, which switches to MedianOfMediansSelect
+// when a subarray isn't at least halved in two partitioning steps, so it takes O(n) time in the worst case
+// and about as long as Select on average.
+// Like Select, places the k-th smallest element at xs[k], smaller or equal elements before it and greater or equal after.
+func IntroSelect[T cmp.Ordered](xs []T, k int) {
+	IntroSelectFunc(xs, k, cmp.Compare[T])
+}
+
+func IntroSelectFunc[T any](xs []T, k int, cmp func(a, b T) int) {
+	steps, halved := 0, len(xs)/2
+	for len(xs) > hybridQuickSortMinArrayLength {
+		p := medianOfThreePartition(xs, cmp)
+		if k < p {
+			xs = xs[:p]
+		} else if k > p {
+			xs, k = xs[p+1:], k-p-1
+		} else {
+			return
+		}
+
+		steps++
+		if steps == 2 {
+			if len(xs) > halved {
+				MedianOfMediansSelectFunc(xs, k, cmp)
+				return
+			}
+			steps, halved = 0, len(xs)/2
+		}
+	}
+	InsertionSort2Func(xs, cmp)
+}
+
+// Places the k smallest elements in sorted order at the beginning of xs, the rest in unspecified order after them.
+// Takes O(n + k*log(k)) time instead of O(n*log(n)) of a full sort.
+// k is clamped to [0, len(xs)], so a negative k is the same as zero and a k greater than len(xs) sorts all of xs.
+// Not stable.
+func PartialSort[T cmp.Ordered](xs []T, k int) {
+	PartialSortFunc(xs, k, cmp.Compare[T])
+}
+
+func PartialSortFunc[T any](xs []T, k int, cmp func(a, b T) int) {
+	k = max(0, min(k, len(xs)))
+	if k < len(xs) {
+		IntroSelectFunc(xs, k, cmp)
+	}
+	PdqSortFunc(xs[:k], cmp)
+}
+
+// Returns the k largest elements of xs in decreasing order.
+// Reorders xs, so that they're at the end of it, and returns that part of xs, the rest isn't sorted.
+// If k is greater than len(xs), returns all elements, and if it's negative, returns none.
+func TopK[T cmp.Ordered](xs []T, k int) []T {
+	return TopKFunc(xs, k, cmp.Compare[T])
+}
+
+func TopKFunc[T any](xs []T, k int, cmp func(a, b T) int) []T {
+	greater := func(a, b T) int { return cmp(b, a) }
+	top := xs[len(xs)-max(0, min(k, len(xs))):]
+	if len(top) < len(xs) {
+		IntroSelectFunc(xs, len(xs)-len(top), cmp)
+	}
+	PdqSortFunc(top, greater)
+	return top
+}
+
+// Returns the k largest elements of seq in decreasing order, or all of them if there are less than k.
+// Keeps them in a min-heap of size k, so it takes O(min(n, k)) memory and O(n*log(k)) time.
+func TopKSeq[T cmp.Ordered](seq iter.Seq[T], k int) []T {
+	return TopKSeqFunc(seq, k, cmp.Compare[T])
+}
+
+func TopKSeqFunc[T any](seq iter.Seq[T], k int, cmp func(a, b T) int) []T {
+	if k <= 0 {
+		return nil
+	}
+
+	// The smallest of the k largest elements seen so far is on top
+	h := NewHeapFunc(nil, cmp)
+	for x := range seq {
+		if h.Len() < k {
+			h.Push(x)
+		} else if cmp(x, h.Top()) > 0 {
+			h.ReplaceTop(x)
+		}
+	}
+
+	top := make([]T, h.Len())
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = h.Pop()
+	}
+	return top
+}
+
+// Places several order statistics at once: for every k in ks, the k-th smallest element is at xs[k],
+// smaller or equal elements before it and greater or equal after, like Select does for a single k.
+// Partitions recursively, and only goes into parts which contain some of ks,
+// so it's faster than calling Select for each k separately, e.g. for computing percentiles.
+// Panics if some k is not in [0, len(xs)).
+func MultiSelect[T cmp.Ordered](xs []T, ks []int) {
+	MultiSelectFunc(xs, ks, cmp.Compare[T])
+}
+
+func MultiSelectFunc[T any](xs []T, ks []int, cmp func(a, b T) int) {
+	if !IsSorted(ks) {
+		ks = append([]int(nil), ks...)
+		PdqSort(ks)
+	}
+	if len(ks) > 0 && (ks[0] < 0 || ks[len(ks)-1] >= len(xs)) {
+		panic(fmt.Sprintf("k out of range [0, %d) in %v", len(xs), ks))
+	}
+	multiSelectImpl(xs, 0, ks, cmp)
+}
+
+// Selects sorted ks in xs, which starts at index offset of the whole slice
+func multiSelectImpl[T any](xs []T, offset int, ks []int, cmp func(a, b T) int) {
+	statsEnter()
+	defer statsLeave()
+
+	// Like IntroSelect, partitions around the median of medians if the larger part isn't halved in two steps
+	steps, halved, medianOfMedians := 0, len(xs)/2, false
+	for len(ks) > 1 && len(xs) > hybridQuickSortMinArrayLength {
+		var lt, gt int
+		if medianOfMedians {
+			p := medianOfMediansPivot(xs, cmp)
+			Exchange(&xs[p], &xs[len(xs)-1])
+			lt, gt = ThreeWayPartitionFunc(xs, cmp)
+		} else {
+			p := medianOfThreePartition(xs, cmp)
+			lt, gt = p, p+1
+		}
+
+		// ks[:i] are in the left part, ks[j:] are in the right part, ks[i:j] are already in place
+		i := 0
+		for i < len(ks) && ks[i] < offset+lt {
+			i++
+		}
+		j := i
+		for j < len(ks) && ks[j] < offset+gt {
+			j++
+		}
+
+		// Recurse into the smaller part to limit the depth of recursion, continue with the larger one
+		if lt < len(xs)-gt {
+			multiSelectImpl(xs[:lt], offset, ks[:i], cmp)
+			xs, offset, ks = xs[gt:], offset+gt, ks[j:]
+		} else {
+			multiSelectImpl(xs[gt:], offset+gt, ks[j:], cmp)
+			xs, ks = xs[:lt], ks[:i]
+		}
+
+		steps++
+		if steps == 2 {
+			steps, halved, medianOfMedians = 0, len(xs)/2, len(xs) > halved
+		}
+	}
+
+	if len(ks) == 1 {
+		// IntroSelect guarantees linear time even if median-of-three partitioning goes bad
+		IntroSelectFunc(xs, ks[0]-offset, cmp)
+	} else if len(ks) > 1 {
+		InsertionSort2Func(xs, cmp)
+	}
+}
+
+// Enables checks of merge invariants, such as sortedness of inputs and outputs, on every merge.
+// The checks are O(n) each, which makes the merge sorts do O(n log n) extra work, so they are meant for debugging only.
+// A failed check panics. Set it before sorting, it's not synchronized with running merges.
+var MergeDebugChecks = false
+
+var (
+	ErrAuxTooSmall     = errors.New("aux is too small")
+	ErrOutTooSmall     = errors.New("out is too small")
+	ErrUnsortedInput   = errors.New("input is not sorted")
+	ErrIndexOutOfRange = errors.New("index is out of range")
+)
+
+// Validates the length of aux of sorts that need it to be at least as long as xs
+func checkAux[T any](xs []T, aux []T) error {
+	if len(aux) < len(xs) {
+		return fmt.Errorf("%w: len(aux) = %d, want at least %d", ErrAuxTooSmall, len(aux), len(xs))
+	}
+	return nil
+}
+
+// Validates the inputs of MergeInto and MergeInto2 except for aux
+func checkMerge[T any](out []T, xs []T, ys []T, cmp func(a, b T) int) error {
+	if len(out) < len(xs)+len(ys) {
+		return fmt.Errorf("%w: len(out) = %d, want at least %d", ErrOutTooSmall, len(out), len(xs)+len(ys))
+	}
+	if !IsSortedFunc(xs, cmp) {
+		return fmt.Errorf("%w: xs", ErrUnsortedInput)
+	}
+	if !IsSortedFunc(ys, cmp) {
+		return fmt.Errorf("%w: ys", ErrUnsortedInput)
+	}
+	return nil
+}
+
+// Validates the inputs of MergeInside
+func checkMergeInside[T any](xs []T, m int, aux []T, cmp func(a, b T) int) error {
+	if m < -1 || m >= len(xs) {
+		return fmt.Errorf("%w: m = %d, want it in [-1, %d)", ErrIndexOutOfRange, m, len(xs))
+	}
+	if len(aux) < len(xs) {
+		return fmt.Errorf("%w: len(aux) = %d, want at least %d", ErrAuxTooSmall, len(aux), len(xs))
+	}
+	if !IsSortedFunc(xs[:m+1], cmp) {
+		return fmt.Errorf("%w: xs[:m+1]", ErrUnsortedInput)
+	}
+	if !IsSortedFunc(xs[m+1:], cmp) {
+		return fmt.Errorf("%w: xs[m+1:]", ErrUnsortedInput)
+	}
+	return nil
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 8.1.
+// Assumes out, xs, and ys do not intersect!
+// Stable: takes elements of xs first on ties.
+func MergeInto[T cmp.Ordered](out []T, xs []T, ys []T) {
+	MergeIntoFunc(out, xs, ys, cmp.Compare[T])
+}
+
+func MergeIntoFunc[T any](out []T, xs []T, ys []T, cmp func(a, b T) int) {
+	N, M := len(xs), len(ys)
+
+	if MergeDebugChecks {
+		if err := checkMerge(out, xs, ys, cmp); err != nil {
+			panic(err)
+		}
+	}
+
+	for i, j, k := 0, 0, 0; k < N+M; k++ {
+		if i == N {
+			out[k] = ys[j]
+			j++
+			continue
+		}
+
+		if j == M {
+			out[k] = xs[i]
+			i++
+			continue
+		}
+
+		// Take from ys only if its element is strictly less, so ties go to xs
+		if cmp(ys[j], xs[i]) < 0 {
+			out[k] = ys[j]
+			j++
+		} else {
+			out[k] = xs[i]
+			i++
+		}
+	}
+
+	statsMoves(N + M)
+
+	if MergeDebugChecks && !IsSortedFunc(out[:N+M], cmp) {
+		panic("out array must be sorted")
+	}
+}
+
+// Same as MergeInto, but validates the input and returns an error instead of merging if it's invalid.
+// Takes O(len(xs)+len(ys)) extra time to check that xs and ys are sorted.
+func MergeIntoChecked[T cmp.Ordered](out []T, xs []T, ys []T) error {
+	return MergeIntoCheckedFunc(out, xs, ys, cmp.Compare[T])
+}
+
+func MergeIntoCheckedFunc[T any](out []T, xs []T, ys []T, cmp func(a, b T) int) error {
+	if err := checkMerge(out, xs, ys, cmp); err != nil {
+		return err
+	}
+	MergeIntoFunc(out, xs, ys, cmp)
+	return nil
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 8.2.
+// Does only one check inside the loop compared to MergeInto which does three checks.
+// Stable: takes elements of the left part first on ties.
+func MergeInside[T cmp.Ordered](xs []T, m int, aux []T) {
+	MergeInsideFunc(xs, m, aux, cmp.Compare[T])
+}
+
+func MergeInsideFunc[T any](xs []T, m int, aux []T, cmp func(a, b T) int) {
+	// fmt.Printf("MergeInside:\n")
+	// fmt.Printf("  m: %v\n", m)
+	// fmt.Printf("  l: %v\n", xs[:m+1])
+	// fmt.Printf("  r: %v\n", xs[m+1:])
+
+	if MergeDebugChecks {
+		if err := checkMergeInside(xs, m, aux, cmp); err != nil {
+			panic(err)
+		}
+	}
+
+	i, j, r := 0, 0, len(xs)-1
+
+	// Copies left part of xs into left part of aux in forward order
+	// aux[l:m] = xs[l:m]
+	for i = m + 1; i > 0; i-- {
+		aux[i-1] = xs[i-1]
+	}
+	// i = 0, left border of aux = left border of the left part of xs
+
+	// Copies right part of xs into right part of aux in reverse order
+	// aux[m:r] = reverse(xs[m+1:r])
+	for j = m; j < r; j++ {
+		aux[r+m-j] = xs[j+1]
+	}
+	// j = r, right border of aux = left border of the reversed right part of xs
+
+	// Merges aux[l:m] with left part of xs and aux[m:r] with reversed right part of xs into xs.
+	// When the left part is exhausted, i walks the reversed right part from its greatest element,
+	// so it must not be taken on ties, otherwise equal elements of the right part are reordered.
+	for k := 0; k <= r; k++ {
+		if i <= m && cmp(aux[j], aux[i]) >= 0 {
+			xs[k] = aux[i]
+			i++
+		} else {
+			xs[k] = aux[j]
+			j--
+		}
+	}
+
+	// fmt.Printf("  xs: %v\n", xs)
+	statsMoves(2 * len(xs))
+
+	if MergeDebugChecks && !IsSortedFunc(xs, cmp) {
+		panic("input array after merge must be sorted")
+	}
+}
+
+// Same as MergeInside, but validates the input and returns an error instead of merging if it's invalid.
+// Takes O(len(xs)) extra time to check that both parts of xs are sorted.
+func MergeInsideChecked[T cmp.Ordered](xs []T, m int, aux []T) error {
+	return MergeInsideCheckedFunc(xs, m, aux, cmp.Compare[T])
+}
+
+func MergeInsideCheckedFunc[T any](xs []T, m int, aux []T, cmp func(a, b T) int) error {
+	if err := checkMergeInside(xs, m, aux, cmp); err != nil {
+		return err
+	}
+	MergeInsideFunc(xs, m, aux, cmp)
+	return nil
+}
+
+// Merges two slices into an output slice using an auxiliary array.
+// out, xs, ys can intersect. Assumes aux doesn't intersect with other arrays.
+//
+// Assumes that:
+//   - out, xs, ys can intersect
+//   - aux doesn't intersect with other arrays
+//   - xs and ys are sorted
+//   - len(out) >= len(xs)+len(ys)
+//   - len(aux) >= len(xs)+len(ys)
+//
+// Stable: takes elements of xs first on ties.
+func MergeInto2[T cmp.Ordered](out []T, xs []T, ys []T, aux []T) {
+	MergeInto2Func(out, xs, ys, aux, cmp.Compare[T])
+}
+
+func MergeInto2Func[T any](out []T, xs []T, ys []T, aux []T, cmp func(a, b T) int) {
+	// fmt.Printf("MergeInto2:\n")
+	// fmt.Printf("  xs: %v\n", xs)
+	// fmt.Printf("  ys: %v\n", ys)
+	// fmt.Printf("  aux: %v\n", aux[:len(out)])
+	// fmt.Printf("  out: %v\n", out)
+	if MergeDebugChecks {
+		if err := checkMerge(out, xs, ys, cmp); err != nil {
+			panic(err)
+		}
+		if len(aux) < len(xs)+len(ys) {
+			panic(ErrAuxTooSmall)
+		}
+	}
+
+	lx, ly := len(xs), len(ys)
+
+	// Right boundary of aux and out
+	r := lx + ly - 1
+
+	// Copy xs forwards into aux
+	copy(aux, xs)
+
+	// Copy ys backwards into aux
+	for j := lx; j <= r; j++ {
+		aux[j] = ys[r-j] // r-j = lx + ly - 1 - (lx + offset) = ly - 1 - offset
+	}
+
+	// k counts total number of elements minus 1 which is r
+	// i starts from the left boundary 0 and goes up to lx-1
+	// j starts from the right boundary r and goes down to lx
+	//
+	// Ties go to xs. When ys is exhausted, j walks xs from its greatest element, which is never less than aux[i].
+	// When xs is exhausted, i would walk the reversed ys from its greatest element and take it on ties
+	// before equal elements preceding it in ys, so it is checked explicitly.
+	for k, i, j := 0, 0, r; k <= r; k++ {
+		if i < lx && cmp(aux[j], aux[i]) >= 0 {
+			out[k] = aux[i]
+			i++
+		} else {
+			out[k] = aux[j]
+			j--
+		}
+	}
+
+	// fmt.Printf("  out: %v\n", out)
+	statsMoves(2 * (lx + ly))
+
+	if MergeDebugChecks && !IsSortedFunc(out[:lx+ly], cmp) {
+		panic("output array after merge must be sorted")
+	}
+}
+
+// Same as MergeInto2, but validates the input and returns an error instead of merging if it's invalid.
+// Takes O(len(xs)+len(ys)) extra time to check that xs and ys are sorted.
+func MergeInto2Checked[T cmp.Ordered](out []T, xs []T, ys []T, aux []T) error {
+	return MergeInto2CheckedFunc(out, xs, ys, aux, cmp.Compare[T])
+}
+
+func MergeInto2CheckedFunc[T any](out []T, xs []T, ys []T, aux []T, cmp func(a, b T) int) error {
+	if err := checkMerge(out, xs, ys, cmp); err != nil {
+		return err
+	}
+	if len(aux) < len(xs)+len(ys) {
+		return fmt.Errorf("%w: len(aux) = %d, want at least %d", ErrAuxTooSmall, len(aux), len(xs)+len(ys))
+	}
+	MergeInto2Func(out, xs, ys, aux, cmp)
+	return nil
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 8.2.
+// Uses MergeInto2 to simplify working with slices.
+// Stable.
+func TopDownMergeSort[T cmp.Ordered](xs []T, aux []T) {
+	TopDownMergeSortFunc(xs, aux, cmp.Compare[T])
+}
+
+func TopDownMergeSortFunc[T any](xs []T, aux []T, cmp func(a, b T) int) {
+	statsEnter()
+	defer statsLeave()
+
+	// fmt.Printf("TopDownMergeSort")
+	// fmt.Printf("  xs: %v\n", xs)
+	ln := len(xs)
+	if ln <= 1 {
+		return
+	}
+
+	// Using an index to split an array
+
+	// m := (ln - 1) / 2 // =(l+r)/2 where l=0, r=len(xs)-1
+	// fmt.Printf("  m: %v\n", m)
+	// TopDownMergeSortFunc(xs[:m+1], aux, cmp)
+	// TopDownMergeSortFunc(xs[m+1:], aux, cmp)
+	// MergeInsideFunc(xs, m, aux, cmp)
+
+	// Or using two slices, which looks nicer
+
+	m := (ln + 1) / 2 // =1+(ln-1)/2
+	ys, zs := xs[:m], xs[m:]
+	TopDownMergeSortFunc(ys, aux, cmp)
+	TopDownMergeSortFunc(zs, aux, cmp)
+	MergeInto2Func(xs, ys, zs, aux, cmp)
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 8.4.
+func topDownMergeSortABImpl[T any](xs []T, aux []T, cmp func(a, b T) int) {
+	statsEnter()
+	defer statsLeave()
+
+	// fmt.Printf("topDownMergeSortABImpl\n  xs:  %v\n  aux: %v\n", xs, aux)
+	ln := len(xs)
+	if ln <= 1 {
+		return
+	}
+	// if ln <= 10 {
+	// 	InsertionSortFunc(xs, cmp)
+	// 	return
+	// }
+
+	m := (ln + 1) / 2 // =1+(ln-1)/2
+
+	// Swap aux and xs to prevent copying step in merge routine
+	topDownMergeSortABImpl(aux[:m], xs[:m], cmp)
+	topDownMergeSortABImpl(aux[m:], xs[m:], cmp)
+	// fmt.Printf("  m:   %v\n  aux[:m]:  %v\n  aux[m:]: %v\n", m, aux[:m], aux[m:])
+	// Swap aux and xs back
+	MergeIntoFunc(xs, aux[:m], aux[m:], cmp)
+	// fmt.Printf("  xs:   %v\n", xs)
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 8.4.
+// Panics if aux is shorter than xs, see TopDownMergeSortABChecked.
+// Stable.
+func TopDownMergeSortAB[T cmp.Ordered](xs []T, aux []T) {
+	TopDownMergeSortABFunc(xs, aux, cmp.Compare[T])
+}
+
+func TopDownMergeSortABFunc[T any](xs []T, aux []T, cmp func(a, b T) int) {
+	if err := checkAux(xs, aux); err != nil {
+		panic(err)
+	}
+
+	// We swap aux and xs, so they must contain the same data
+	aux = aux[:len(xs)]
+	copy(aux, xs)
+	statsMoves(len(xs))
+
+	topDownMergeSortABImpl(xs, aux, cmp)
+}
+
+// Same as TopDownMergeSortAB, but returns an error instead of sorting if aux is too small.
+func TopDownMergeSortABChecked[T cmp.Ordered](xs []T, aux []T) error {
+	return TopDownMergeSortABCheckedFunc(xs, aux, cmp.Compare[T])
+}
+
+func TopDownMergeSortABCheckedFunc[T any](xs []T, aux []T, cmp func(a, b T) int) error {
+	if err := checkAux(xs, aux); err != nil {
+		return err
+	}
+	TopDownMergeSortABFunc(xs, aux, cmp)
+	return nil
+}
+
+// Stable.
+func BottomUpMergeSort[T cmp.Ordered](xs []T, aux []T) {
+	BottomUpMergeSortFunc(xs, aux, cmp.Compare[T])
+}
+
+func BottomUpMergeSortFunc[T any](xs []T, aux []T, cmp func(a, b T) int) {
+	ln := len(xs)
+	for m := 1; m < ln; m += m {
+		for i := 0; i <= ln-m; i += m + m {
+			r := min(i+m+m, ln)
+			MergeInto2Func(xs[i:r], xs[i:i+m], xs[i+m:r], aux, cmp)
+		}
+	}
+}
+
+// Size of blocks sorted by insertion sort before merging in InPlaceMergeSort
+const inPlaceMergeSortBlockSize = 20
+
+// Reverses xs in place
+func reverse[T any](xs []T) {
+	for i, j := 0, len(xs)-1; i < j; i, j = i+1, j-1 {
+		Exchange(&xs[i], &xs[j])
+	}
+}
+
+// Moves xs[m:] before xs[:m] by three reversals
+func rotate[T any](xs []T, m int) {
+	reverse(xs[:m])
+	reverse(xs[m:])
+	reverse(xs)
+}
+
+// Merges sorted xs[a:m] and xs[m:b] in place.
+// Based on SymMerge from Kim, Kutzner, Stable minimum storage merging by symmetric comparisons, 2004.
+// Finds the longest suffix of xs[a:m] and prefix of xs[m:b] that are symmetric around the middle and should swap places,
+// swaps them with a rotation and recurses into both halves. Takes O(n log n) moves and O(log n) stack.
+func symMerge[T any](xs []T, a, m, b int, cmp func(a, b T) int) {
+	// A single element on the left is inserted into the right part after all elements equal to it
+	if m-a == 1 {
+		i, j := m, b
+		for i < j {
+			h := int(uint(i+j) >> 1)
+			if cmp(xs[h], xs[a]) < 0 {
+				i = h + 1
+			} else {
+				j = h
+			}
+		}
+		for k := a; k < i-1; k++ {
+			Exchange(&xs[k], &xs[k+1])
+		}
+		return
+	}
+
+	// A single element on the right is inserted into the left part after all elements equal to it
+	if b-m == 1 {
+		i, j := a, m
+		for i < j {
+			h := int(uint(i+j) >> 1)
+			if cmp(xs[m], xs[h]) >= 0 {
+				i = h + 1
+			} else {
+				j = h
+			}
+		}
+		for k := m; k > i; k-- {
+			Exchange(&xs[k], &xs[k-1])
+		}
+		return
+	}
+
+	mid := int(uint(a+b) >> 1)
+	n := mid + m
+	var start, r int
+	if m > mid {
+		start, r = n-b, mid
+	} else {
+		start, r = a, m
+	}
+	p := n - 1
+
+	// Binary search for the start of the part of xs[a:m] to be swapped with the part of xs[m:b] mirrored around mid
+	for start < r {
+		c := int(uint(start+r) >> 1)
+		if cmp(xs[p-c], xs[c]) >= 0 {
+			start = c + 1
+		} else {
+			r = c
+		}
+	}
+
+	end := n - start
+	if start < m && m < end {
+		rotate(xs[start:end], m-start)
+	}
+	if a < start && start < mid {
+		symMerge(xs, a, start, mid, cmp)
+	}
+	if mid < end && end < b {
+		symMerge(xs, mid, end, b, cmp)
+	}
+}
+
+// Merges xs[:m+1] with xs[m+1:] like MergeInside, but in place without an auxiliary array.
+// Assumes that both parts are sorted.
+// Stable: takes elements of the left part first on ties.
+func InPlaceMerge[T cmp.Ordered](xs []T, m int) {
+	InPlaceMergeFunc(xs, m, cmp.Compare[T])
+}
+
+func InPlaceMergeFunc[T any](xs []T, m int, cmp func(a, b T) int) {
+	if m+1 > 0 && m+1 < len(xs) {
+		symMerge(xs, 0, m+1, len(xs), cmp)
+	}
+}
+
+// Bottom-up merge sort that merges in place with symMerge, so it doesn't need an auxiliary array.
+// Sorts blocks of inPlaceMergeSortBlockSize elements with insertion sort first.
+// Takes O(n log^2 n) time.
+// Stable.
+func InPlaceMergeSort[T cmp.Ordered](xs []T) {
+	InPlaceMergeSortFunc(xs, cmp.Compare[T])
+}
+
+func InPlaceMergeSortFunc[T any](xs []T, cmp func(a, b T) int) {
+	ln := len(xs)
+	for i := 0; i < ln; i += inPlaceMergeSortBlockSize {
+		InsertionSort2Func(xs[i:min(i+inPlaceMergeSortBlockSize, ln)], cmp)
+	}
+
+	for m := inPlaceMergeSortBlockSize; m < ln; m += m {
+		for i := 0; i < ln-m; i += m + m {
+			symMerge(xs, i, i+m, min(i+m+m, ln), cmp)
+		}
+	}
+}
+
+// The current element of a source during k-way merge
+type mergeKHead[T any] struct {
+	x   T
+	src int
+}
+
+// Merges sorted sources, each given by a function returning its next element and whether it exists,
+// and passes elements to yield until it returns false. Uses a heap of the current elements of sources.
+// Stable: ties go to the source with the smaller index.
+func mergeKImpl[T any](next []func() (T, bool), yield func(T) bool, cmp func(a, b T) int) {
+	heads := make([]mergeKHead[T], 0, len(next))
+	for i, nx := range next {
+		if x, ok := nx(); ok {
+			heads = append(heads, mergeKHead[T]{x: x, src: i})
+		}
+	}
+	h := NewHeapFunc(heads, func(a, b mergeKHead[T]) int {
+		if c := cmp(a.x, b.x); c != 0 {
+			return c
+		}
+		return a.src - b.src
+	})
+
+	for h.Len() > 0 {
+		top := h.Top()
+		if !yield(top.x) {
+			return
+		}
+
+		if x, ok := next[top.src](); ok {
+			h.ReplaceTop(mergeKHead[T]{x: x, src: top.src})
+		} else {
+			h.Pop()
+		}
+	}
+}
+
+// Merges sorted slices into out. Generalizes MergeInto to k inputs.
+// Assumes out doesn't intersect with xss and is at least as long as all xss combined.
+// Stable: ties go to the slice with the smaller index.
+func MergeK[T cmp.Ordered](out []T, xss [][]T) {
+	MergeKFunc(out, xss, cmp.Compare[T])
+}
+
+func MergeKFunc[T any](out []T, xss [][]T, cmp func(a, b T) int) {
+	if MergeDebugChecks {
+		total := 0
+		for _, xs := range xss {
+			if !IsSortedFunc(xs, cmp) {
+				panic(ErrUnsortedInput)
+			}
+			total += len(xs)
+		}
+		if len(out) < total {
+			panic(ErrOutTooSmall)
+		}
+	}
+
+	next := make([]func() (T, bool), len(xss))
+	for i, xs := range xss {
+		next[i] = func() (x T, ok bool) {
+			if len(xs) == 0 {
+				return x, false
+			}
+			x, xs = xs[0], xs[1:]
+			return x, true
+		}
+	}
+
+	k := 0
+	mergeKImpl(next, func(x T) bool {
+		out[k] = x
+		k++
+		return true
+	}, cmp)
+	statsMoves(k)
+}
+
+// Lazily merges sorted sequences. Stable: ties go to the sequence with the smaller index.
+func MergeSeq[T cmp.Ordered](seqs []iter.Seq[T]) iter.Seq[T] {
+	return MergeSeqFunc(seqs, cmp.Compare[T])
+}
+
+func MergeSeqFunc[T any](seqs []iter.Seq[T], cmp func(a, b T) int) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		next := make([]func() (T, bool), len(seqs))
+		for i, seq := range seqs {
+			nx, stop := iter.Pull(seq)
+			defer stop()
+			next[i] = nx
+		}
+		mergeKImpl(next, yield, cmp)
+	}
+}
+
+// Merges sorted channels into the returned channel, which is closed after all input channels are closed.
+// The merging goroutine blocks until the returned channel is drained, or until done is closed:
+// then it stops reading the inputs and closes the returned channel, so a consumer that stops early must close done.
+// Producers of the inputs should watch done as well, since nothing reads them afterwards. done may be nil.
+// Stable: ties go to the channel with the smaller index.
+func MergeChan[T cmp.Ordered](done <-chan struct{}, chs []<-chan T) <-chan T {
+	return MergeChanFunc(done, chs, cmp.Compare[T])
+}
+
+func MergeChanFunc[T any](done <-chan struct{}, chs []<-chan T, cmp func(a, b T) int) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+
+		next := make([]func() (T, bool), len(chs))
+		for i, ch := range chs {
+			next[i] = func() (T, bool) {
+				select {
+				case x, ok := <-ch:
+					return x, ok
+				case <-done:
+					var zero T
+					return zero, false
+				}
+			}
+		}
+		mergeKImpl(next, func(x T) bool {
+			select {
+			case out <- x:
+				return true
+			case <-done:
+				return false
+			}
+		}, cmp)
+	}()
+	return out
+}
+
+// Merges switch to galloping mode after this many elements are taken from one run in a row
+const timSortMinGallop = 7
+
+// A run of sorted elements xs[start:start+length] waiting on the TimSort stack to be merged
+type timSortRun struct {
+	start, length int
+}
+
+// Computes the minimal run length so that n/minRun is equal to or slightly less than a power of two,
+// which keeps merges balanced. See Peters, listsort.txt.
+func timSortMinRun(n int) int {
+	r := 0
+	for n >= 64 {
+		r |= n & 1
+		n >>= 1
+	}
+	return n + r
+}
+
+// Returns the length of the run at the start of xs. A strictly descending run is reversed,
+// non-strictness would break stability.
+func timSortCountRun[T any](xs []T, cmp func(a, b T) int) int {
+	if len(xs) <= 1 {
+		return len(xs)
+	}
+
+	i := 1
+	if cmp(xs[1], xs[0]) < 0 {
+		for i+1 < len(xs) && cmp(xs[i+1], xs[i]) < 0 {
+			i++
+		}
+		for l, r := 0, i; l < r; l, r = l+1, r-1 {
+			Exchange(&xs[l], &xs[r])
+		}
+	} else {
+		for i+1 < len(xs) && cmp(xs[i+1], xs[i]) >= 0 {
 			i++
+		}
+	}
+	return i + 1
+}
+
+// Insertion sort that finds the position using binary search. Assumes xs[:sorted] is already sorted.
+// Inserts after equal elements, so it is stable.
+func binaryInsertionSort[T any](xs []T, sorted int, cmp func(a, b T) int) {
+	for i := max(sorted, 1); i < len(xs); i++ {
+		v := xs[i]
+
+		// Find the first element greater than v
+		l, r := 0, i
+		for l < r {
+			m := int(uint(l+r) >> 1)
+			if cmp(v, xs[m]) < 0 {
+				r = m
+			} else {
+				l = m + 1
+			}
+		}
+
+		copy(xs[l+1:i+1], xs[l:i])
+		xs[l] = v
+		statsMoves(i - l + 1)
+	}
+}
+
+// Returns the number of leading elements of sorted xs that are less than key,
+// or less than or equal to key if inclusive is set.
+// Probes positions 0, 2, 6, 14, … before doing a binary search, so it is fast when the result is small.
+func gallop[T any](key T, xs []T, inclusive bool, cmp func(a, b T) int) int {
+	before := func(x T) bool {
+		if inclusive {
+			return cmp(key, x) >= 0
+		}
+		return cmp(x, key) < 0
+	}
+
+	// Find the range where the result is: xs[:l] are before key, xs[r] is not, if it exists
+	l, r := 0, 1
+	for r <= len(xs) && before(xs[r-1]) {
+		l, r = r, 2*r+1
+	}
+	r = min(r-1, len(xs))
+
+	for l < r {
+		m := int(uint(l+r) >> 1)
+		if before(xs[m]) {
+			l = m + 1
+		} else {
+			r = m
+		}
+	}
+	return l
+}
+
+// Merges sorted xs[:m] and xs[m:]. Copies xs[:m] into aux and merges forward into xs,
+// which never overwrites unmerged elements of xs[m:].
+// Switches to galloping when one run wins timSortMinGallop times in a row, minGallop adapts to the data.
+func timSortMergeLo[T any](xs []T, m int, aux []T, minGallop *int, cmp func(a, b T) int) {
+	a := aux[:m]
+	copy(a, xs[:m])
+
+	i, j, k := 0, m, 0
+	winsA, winsB := 0, 0
+	for i < len(a) && j < len(xs) {
+		// Take from the left run on ties for stability
+		if cmp(xs[j], a[i]) < 0 {
+			xs[k] = xs[j]
+			j++
+			winsA, winsB = 0, winsB+1
+		} else {
+			xs[k] = a[i]
+			i++
+			winsA, winsB = winsA+1, 0
+		}
+		k++
+
+		if winsA < *minGallop && winsB < *minGallop {
 			continue
 		}
 
-		if cmp.Less(xs[i], ys[j]) {
-			out[k] = xs[i]
-			i++
-		} else {
-			out[k] = ys[j]
+		// Galloping mode: copy whole chunks while they are long enough
+		for i < len(a) && j < len(xs) {
+			c := gallop(xs[j], a[i:], true, cmp)
+			copy(xs[k:], a[i:i+c])
+			i, k = i+c, k+c
+			if i == len(a) {
+				break
+			}
+
+			d := gallop(a[i], xs[j:], false, cmp)
+			copy(xs[k:], xs[j:j+d])
+			j, k = j+d, k+d
+
+			if c < timSortMinGallop && d < timSortMinGallop {
+				// Leave galloping mode and make it harder to enter again
+				*minGallop++
+				break
+			}
+			*minGallop = max(1, *minGallop-1)
+		}
+		winsA, winsB = 0, 0
+	}
+
+	// Remaining elements of xs[m:] are already in place
+	copy(xs[k:], a[i:])
+
+	// The left run is copied to aux and back, the right one moves up to where it's taken from
+	statsMoves(m + j)
+}
+
+// Merges runs i and i+1 of the stack and replaces them with the merged run.
+func timSortMergeAt[T any](xs []T, runs []timSortRun, i int, aux []T, minGallop *int, cmp func(a, b T) int) []timSortRun {
+	a, b := runs[i], runs[i+1]
+	runs[i].length += b.length
+	runs = append(runs[:i+1], runs[i+2:]...)
+
+	ys := xs[a.start : b.start+b.length]
+	m := a.length
+
+	// Elements at the start of the left run that are not greater than the first element of the right run are in place
+	k := gallop(ys[m], ys[:m], true, cmp)
+	ys, m = ys[k:], m-k
+	if m == 0 {
+		return runs
+	}
+
+	// Elements at the end of the right run that are not less than the last element of the left run are in place
+	ys = ys[:m+gallop(ys[m-1], ys[m:], false, cmp)]
+
+	timSortMergeLo(ys, m, aux, minGallop, cmp)
+	return runs
+}
+
+// Merges runs on top of the stack until lengths of runs satisfy invariants
+// `runs[i-2] > runs[i-1] + runs[i]` and `runs[i-1] > runs[i]`, so the stack depth is logarithmic.
+// Checks the two topmost triples, see de Gouw et al., OpenJDK's java.utils.Collection.sort() is broken.
+func timSortMergeCollapse[T any](xs []T, runs []timSortRun, aux []T, minGallop *int, cmp func(a, b T) int) []timSortRun {
+	for len(runs) > 1 {
+		n := len(runs) - 2
+		if n > 0 && runs[n-1].length <= runs[n].length+runs[n+1].length ||
+			n > 1 && runs[n-2].length <= runs[n-1].length+runs[n].length {
+			// Merge the smaller of the outer runs with the middle one
+			if runs[n-1].length < runs[n+1].length {
+				n--
+			}
+		} else if runs[n].length > runs[n+1].length {
+			break
+		}
+		runs = timSortMergeAt(xs, runs, n, aux, minGallop, cmp)
+	}
+	return runs
+}
+
+// Natural merge sort that finds existing runs, extends short ones to minimal run length using binaryInsertionSort
+// and merges them keeping TimSort's stack invariants. Stable.
+// See Peters, listsort.txt, https://github.com/python/cpython/blob/main/Objects/listsort.txt.
+// Panics if aux is shorter than xs, see TimSortChecked.
+func TimSort[T cmp.Ordered](xs []T, aux []T) {
+	TimSortFunc(xs, aux, cmp.Compare[T])
+}
+
+func TimSortFunc[T any](xs []T, aux []T, cmp func(a, b T) int) {
+	// Fail before sorting rather than in the middle of a merge
+	if err := checkAux(xs, aux); err != nil {
+		panic(err)
+	}
+	aux = aux[:len(xs)]
+
+	n := len(xs)
+	minRun := timSortMinRun(n)
+	minGallop := timSortMinGallop
+	runs := make([]timSortRun, 0, 64)
+
+	for l := 0; l < n; {
+		ln := timSortCountRun(xs[l:], cmp)
+		if ln < minRun {
+			// Extend the run to minRun elements
+			r := min(minRun, n-l)
+			binaryInsertionSort(xs[l:l+r], ln, cmp)
+			ln = r
+		}
+
+		runs = append(runs, timSortRun{start: l, length: ln})
+		runs = timSortMergeCollapse(xs, runs, aux, &minGallop, cmp)
+		l += ln
+	}
+
+	// Merge the remaining runs from the top of the stack
+	for len(runs) > 1 {
+		runs = timSortMergeAt(xs, runs, len(runs)-2, aux, &minGallop, cmp)
+	}
+}
+
+// Same as TimSort, but returns an error instead of sorting if aux is too small.
+func TimSortChecked[T cmp.Ordered](xs []T, aux []T) error {
+	return TimSortCheckedFunc(xs, aux, cmp.Compare[T])
+}
+
+func TimSortCheckedFunc[T any](xs []T, aux []T, cmp func(a, b T) int) error {
+	if err := checkAux(xs, aux); err != nil {
+		return err
+	}
+	TimSortFunc(xs, aux, cmp)
+	return nil
+}
+
+// Subarrays of this length or smaller are sorted and merged on the current goroutine
+const parallelMergeSortMinArrayLength = 1 << 12
+
+// Runs f and g and waits for both. f runs on a new goroutine if sem has room for one more worker.
+func parallelDo(sem chan struct{}, f, g func()) {
+	select {
+	case sem <- struct{}{}:
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			f()
+		}()
+		g()
+		wg.Wait()
+	default:
+		f()
+		g()
+	}
+}
+
+// Merges sorted xs and ys into out. Splits the longer input in half, finds where its middle element goes
+// in the other one using binary search and merges both sides independently.
+// Assumes out doesn't intersect with xs and ys. Stable.
+func parallelMerge[T any](out []T, xs []T, ys []T, sem chan struct{}, cmp func(a, b T) int) {
+	if len(out) <= parallelMergeSortMinArrayLength {
+		MergeIntoFunc(out, xs, ys, cmp)
+		return
+	}
+
+	// The middle element goes after equal elements of xs and before equal elements of ys
+	var i, j int
+	if len(xs) >= len(ys) {
+		i = len(xs) / 2
+		j = gallop(xs[i], ys, false, cmp)
+		out[i+j] = xs[i]
+		statsMoves(1)
+		parallelDo(sem,
+			func() { parallelMerge(out[:i+j], xs[:i], ys[:j], sem, cmp) },
+			func() { parallelMerge(out[i+j+1:], xs[i+1:], ys[j:], sem, cmp) })
+	} else {
+		j = len(ys) / 2
+		i = gallop(ys[j], xs, true, cmp)
+		out[i+j] = ys[j]
+		statsMoves(1)
+		parallelDo(sem,
+			func() { parallelMerge(out[:i+j], xs[:i], ys[:j], sem, cmp) },
+			func() { parallelMerge(out[i+j+1:], xs[i:], ys[j+1:], sem, cmp) })
+	}
+}
+
+// Like topDownMergeSortABImpl, but sorts halves and merges them in parallel.
+func parallelMergeSortImpl[T any](xs []T, aux []T, sem chan struct{}, cmp func(a, b T) int) {
+	ln := len(xs)
+	if ln <= parallelMergeSortMinArrayLength {
+		topDownMergeSortABImpl(xs, aux, cmp)
+		return
+	}
+
+	m := (ln + 1) / 2 // =1+(ln-1)/2
+
+	// Swap aux and xs to prevent copying step in merge routine
+	parallelDo(sem,
+		func() { parallelMergeSortImpl(aux[:m], xs[:m], sem, cmp) },
+		func() { parallelMergeSortImpl(aux[m:], xs[m:], sem, cmp) })
+	parallelMerge(xs, aux[:m], aux[m:], sem, cmp)
+}
+
+// Based on TopDownMergeSortAB, runs recursive calls and merges on up to `workers` goroutines.
+// Panics if aux is shorter than xs, see ParallelMergeSortChecked.
+// Stable.
+func ParallelMergeSort[T cmp.Ordered](xs []T, aux []T) {
+	ParallelMergeSortFunc(xs, aux, 0, cmp.Compare[T])
+}
+
+// If workers <= 0, uses GOMAXPROCS workers.
+func ParallelMergeSortFunc[T any](xs []T, aux []T, workers int, cmp func(a, b T) int) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// The current goroutine is one of the workers
+	sem := make(chan struct{}, workers-1)
+
+	if err := checkAux(xs, aux); err != nil {
+		panic(err)
+	}
+
+	// We swap aux and xs, so they must contain the same data
+	aux = aux[:len(xs)]
+	copy(aux, xs)
+	statsMoves(len(xs))
+
+	parallelMergeSortImpl(xs, aux, sem, cmp)
+}
+
+// Same as ParallelMergeSort, but returns an error instead of sorting if aux is too small.
+func ParallelMergeSortChecked[T cmp.Ordered](xs []T, aux []T) error {
+	return ParallelMergeSortCheckedFunc(xs, aux, 0, cmp.Compare[T])
+}
+
+func ParallelMergeSortCheckedFunc[T any](xs []T, aux []T, workers int, cmp func(a, b T) int) error {
+	if err := checkAux(xs, aux); err != nil {
+		return err
+	}
+	ParallelMergeSortFunc(xs, aux, workers, cmp)
+	return nil
+}
+
+// Subarrays of this length or smaller are sorted by a single worker
+const parallelQuickSortMinArrayLength = 1 << 12
+
+// Shared stack of subarrays to partition, like the one in NonRecursiveQuickSort.
+// pending counts subarrays pushed, but not processed yet, so workers know when to stop.
+type parallelQuickSortQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	stack   []int // `l, r, depth` triples, r is inclusive
+	pending int
+}
+
+func (q *parallelQuickSortQueue) push(l, r, depth int) {
+	q.mu.Lock()
+	q.stack = append(q.stack, l, r, depth)
+	q.pending++
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// Blocks until there is a subarray to process. Returns false when all subarrays are processed.
+func (q *parallelQuickSortQueue) pop() (int, int, int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.stack) == 0 && q.pending > 0 {
+		q.cond.Wait()
+	}
+	if q.pending == 0 {
+		return 0, 0, 0, false
+	}
+
+	n := len(q.stack)
+	l, r, depth := q.stack[n-3], q.stack[n-2], q.stack[n-1]
+	q.stack = q.stack[:n-3]
+	return l, r, depth, true
+}
+
+// Marks a popped subarray as processed, wakes up all workers to stop if it was the last one.
+func (q *parallelQuickSortQueue) done() {
+	q.mu.Lock()
+	q.pending--
+	last := q.pending == 0
+	q.mu.Unlock()
+	if last {
+		q.cond.Broadcast()
+	}
+}
+
+// Based on NonRecursiveQuickSort, `workers` goroutines pop subarrays from a shared stack,
+// partition them using median-of-three and push both parts back.
+// Small subarrays and subarrays deeper than 2*log2(n) are sorted using HybridQuickSort.
+// Not stable.
+func ParallelQuickSort[T cmp.Ordered](xs []T) {
+	ParallelQuickSortFunc(xs, 0, cmp.Compare[T])
+}
+
+// If workers <= 0, uses GOMAXPROCS workers.
+func ParallelQuickSortFunc[T any](xs []T, workers int, cmp func(a, b T) int) {
+	if len(xs) <= parallelQuickSortMinArrayLength {
+		HybridQuickSortFunc(xs, cmp)
+		return
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	q := &parallelQuickSortQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	q.push(0, len(xs)-1, 2*(bits.Len(uint(len(xs)))-1))
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				l, r, depth, ok := q.pop()
+				if !ok {
+					return
+				}
+
+				if r-l+1 <= parallelQuickSortMinArrayLength || depth == 0 {
+					HybridQuickSortFunc(xs[l:r+1], cmp)
+				} else {
+					// `l+` because the partition returns an offset from `l`
+					i := l + medianOfThreePartition(xs[l:r+1], cmp)
+					q.push(l, i-1, depth-1)
+					q.push(i+1, r, depth-1)
+				}
+				q.done()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Number of buckets per worker in SampleSort, more buckets balance work between workers better
+const sampleSortBucketsPerWorker = 4
+
+// Number of sampled elements per bucket, more samples make bucket sizes closer to each other
+const sampleSortOversampling = 16
+
+// Arrays of this length or smaller are sorted using PdqSort
+const sampleSortMinArrayLength = 1 << 14
+
+// Calls f on `workers` consecutive chunks of [0, n) concurrently and waits for all of them.
+func parallelChunks(n, workers int, f func(w, l, r int)) {
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f(w, w*n/workers, (w+1)*n/workers)
+		}()
+	}
+	wg.Wait()
+}
+
+// Parallel sample sort: sorts evenly spaced samples to choose splitters, distributes elements into buckets
+// between splitters in parallel and sorts buckets concurrently using PdqSort.
+// Samples are chosen deterministically, so the result doesn't depend on scheduling.
+// Panics if aux is shorter than xs, see SampleSortChecked.
+// Not stable.
+func SampleSort[T cmp.Ordered](xs []T, aux []T) {
+	SampleSortFunc(xs, aux, 0, cmp.Compare[T])
+}
+
+// If workers <= 0, uses GOMAXPROCS workers.
+func SampleSortFunc[T any](xs []T, aux []T, workers int, cmp func(a, b T) int) {
+	if err := checkAux(xs, aux); err != nil {
+		panic(err)
+	}
+	aux = aux[:len(xs)]
+
+	n := len(xs)
+	if n <= sampleSortMinArrayLength {
+		PdqSortFunc(xs, cmp)
+		return
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// Choose k-1 splitters from k*sampleSortOversampling sorted samples
+	k := workers * sampleSortBucketsPerWorker
+	samples := make([]T, k*sampleSortOversampling)
+	for i := range samples {
+		samples[i] = xs[i*n/len(samples)]
+	}
+	PdqSortFunc(samples, cmp)
+	splitters := make([]T, k-1)
+	for i := range splitters {
+		splitters[i] = samples[(i+1)*sampleSortOversampling]
+	}
+
+	// Bucket b contains elements x such that splitters[b-1] <= x < splitters[b]
+	bucket := func(x T) int {
+		return gallop(x, splitters, true, cmp)
+	}
+
+	// Count elements of each chunk in each bucket
+	cnt := make([][]int, workers)
+	parallelChunks(n, workers, func(w, l, r int) {
+		cnt[w] = make([]int, k)
+		for _, x := range xs[l:r] {
+			cnt[w][bucket(x)]++
+		}
+	})
+
+	// Turn counts into starting positions: buckets go in order, chunks go in order inside each bucket
+	start := make([]int, k+1)
+	for b, pos := 0, 0; b < k; b++ {
+		start[b] = pos
+		for w := 0; w < workers; w++ {
+			pos, cnt[w][b] = pos+cnt[w][b], pos
+		}
+	}
+	start[k] = n
+
+	// Distribute elements into buckets in aux
+	parallelChunks(n, workers, func(w, l, r int) {
+		for _, x := range xs[l:r] {
+			b := bucket(x)
+			aux[cnt[w][b]] = x
+			cnt[w][b]++
+		}
+	})
+
+	// Sort buckets and copy them back, each worker takes the next unsorted bucket
+	var next atomic.Int64
+	parallelChunks(workers, workers, func(w, l, r int) {
+		for b := int(next.Add(1) - 1); b < k; b = int(next.Add(1) - 1) {
+			PdqSortFunc(aux[start[b]:start[b+1]], cmp)
+			copy(xs[start[b]:start[b+1]], aux[start[b]:start[b+1]])
+		}
+	})
+
+	// Every element is distributed into aux and copied back
+	statsMoves(2 * n)
+}
+
+// Same as SampleSort, but returns an error instead of sorting if aux is too small.
+func SampleSortChecked[T cmp.Ordered](xs []T, aux []T) error {
+	return SampleSortCheckedFunc(xs, aux, 0, cmp.Compare[T])
+}
+
+func SampleSortCheckedFunc[T any](xs []T, aux []T, workers int, cmp func(a, b T) int) error {
+	if err := checkAux(xs, aux); err != nil {
+		return err
+	}
+	SampleSortFunc(xs, aux, workers, cmp)
+	return nil
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 9.3.
+// Moves xs[k] up while it is less than its parent. Children of xs[k] are xs[2k+1] and xs[2k+2].
+func heapSiftUp[T any](xs []T, k int, compare func(a, b T) int) {
+	for k > 0 {
+		p := (k - 1) / 2
+		if compare(xs[k], xs[p]) >= 0 {
+			break
+		}
+		Exchange(&xs[k], &xs[p])
+		k = p
+	}
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 9.4.
+// Moves xs[k] down while it is greater than any of its children.
+func heapSiftDown[T any](xs []T, k int, compare func(a, b T) int) {
+	n := len(xs)
+	for 2*k+1 < n {
+		// Choose the smallest child
+		j := 2*k + 1
+		if j+1 < n && compare(xs[j+1], xs[j]) < 0 {
 			j++
 		}
+		if compare(xs[k], xs[j]) <= 0 {
+			break
+		}
+		Exchange(&xs[k], &xs[j])
+		k = j
 	}
+}
 
-	Assert(IsSorted(out[:N+M]), "out array must be sorted")
+// Based on Sedgewick, Algorithms in C++, prog. 9.7.
+// Builds a heap bottom-up, so that xs[0] is the smallest element according to compare.
+func Heapify[T any](xs []T, compare func(a, b T) int) {
+	for k := len(xs)/2 - 1; k >= 0; k-- {
+		heapSiftDown(xs, k, compare)
+	}
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 8.2.
-// Does only one check inside the loop compared to MergeInto which does three checks.
-// TODO: write a test
-func MergeInside[T cmp.Ordered](xs []T, m int, aux []T) {
-	// fmt.Printf("MergeInside:\n")
-	// fmt.Printf("  m: %v\n", m)
-	// fmt.Printf("  l: %v\n", xs[:m+1])
-	// fmt.Printf("  r: %v\n", xs[m+1:])
+// Binary heap ordered by compare, the smallest element is on top.
+// Swap arguments of compare to get a max-heap.
+type Heap[T any] struct {
+	xs      []T
+	compare func(a, b T) int
+}
 
-	Assert(IsSorted(xs[:m+1]), "input array part before provided index must be sorted")
-	Assert(IsSorted(xs[m+1:]), "input array part after provided index must be sorted")
-	Assert(len(aux) >= len(xs), "buffer is smaller than the merged array")
+// Creates a heap of cmp.Ordered elements. Reuses and reorders xs.
+func NewHeap[T cmp.Ordered](xs []T) *Heap[T] {
+	return NewHeapFunc(xs, cmp.Compare[T])
+}
 
-	i, j, r := 0, 0, len(xs)-1
+// Creates a heap ordered by compare. Reuses and reorders xs.
+func NewHeapFunc[T any](xs []T, compare func(a, b T) int) *Heap[T] {
+	Heapify(xs, compare)
+	return &Heap[T]{xs: xs, compare: compare}
+}
 
-	// Copies left part of xs into left part of aux in forward order
-	// aux[l:m] = xs[l:m]
-	for i = m + 1; i > 0; i-- {
-		aux[i-1] = xs[i-1]
-	}
-	// i = 0, left border of aux = left border of the left part of xs
+func (h *Heap[T]) Len() int {
+	return len(h.xs)
+}
 
-	// Copies right part of xs into right part of aux in reverse order
-	// aux[m:r] = reverse(xs[m+1:r])
-	for j = m; j < r; j++ {
-		aux[r+m-j] = xs[j+1]
+// Returns the smallest element without removing it. The heap must not be empty.
+func (h *Heap[T]) Top() T {
+	return h.xs[0]
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 9.5.
+func (h *Heap[T]) Push(x T) {
+	h.xs = append(h.xs, x)
+	heapSiftUp(h.xs, len(h.xs)-1, h.compare)
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 9.5.
+// Removes and returns the smallest element. The heap must not be empty.
+func (h *Heap[T]) Pop() T {
+	r := len(h.xs) - 1
+	Exchange(&h.xs[0], &h.xs[r])
+	x := h.xs[r]
+	h.xs = h.xs[:r]
+	heapSiftDown(h.xs, 0, h.compare)
+	return x
+}
+
+// Replaces the smallest element with x and returns the replaced one. The heap must not be empty.
+// Does one sift instead of two compared to Pop followed by Push.
+func (h *Heap[T]) ReplaceTop(x T) T {
+	top := h.xs[0]
+	h.xs[0] = x
+	heapSiftDown(h.xs, 0, h.compare)
+	return top
+}
+
+// Based on Sedgewick, Algorithms in C++, prog. 9.7.
+// Not stable.
+func HeapSort[T cmp.Ordered](xs []T) {
+	HeapSortFunc(xs, cmp.Compare[T])
+}
+
+func HeapSortFunc[T any](xs []T, cmp func(a, b T) int) {
+	// Build a max-heap, so that the greatest element is on top
+	greater := func(a, b T) int { return cmp(b, a) }
+	Heapify(xs, greater)
+
+	// Move the greatest element to the end and restore the heap in the remaining part
+	for r := len(xs) - 1; r > 0; r-- {
+		Exchange(&xs[0], &xs[r])
+		heapSiftDown(xs[:r], 0, greater)
 	}
-	// j = r, right border of aux = left border of the reversed right part of xs
+}
 
-	// Merges aux[l:m] with left part of xs and aux[m:r] with reversed right part of xs into xs
-	for k := 0; k <= r; k++ {
-		if cmp.Less(aux[j], aux[i]) {
-			xs[k] = aux[j]
-			j--
-		} else {
-			xs[k] = aux[i]
-			i++
+// Default memory budget of ExternalSort in bytes
+const externalSortDefaultMemory = 64 << 20
+
+// Approximate memory used by each record in addition to its bytes: slice headers in the chunk and in aux
+const externalSortRecordOverhead = 48
+
+// Size of the write buffer and the minimal size of read buffers of run files
+const externalSortMinBufferSize = 4 << 10
+
+// Maximal number of runs merged at once, limits the number of open files
+const externalSortMaxFanIn = 64
+
+type ExternalSortOptions struct {
+	// Length of fixed-width records in bytes. If 0, records are newline-delimited.
+	RecordSize int
+	// Approximate number of bytes of records to keep in memory. If 0, uses externalSortDefaultMemory.
+	Memory int
+	// Directory for temporary run files. If empty, uses os.TempDir().
+	TempDir string
+	// Compares records. If nil, uses bytes.Compare.
+	Cmp func(a, b []byte) int
+}
+
+// Reads the next record without the delimiter. Returns io.EOF when there are no more records.
+// The last newline-delimited record may lack the newline.
+func readRecord(br *bufio.Reader, size int) ([]byte, error) {
+	if size > 0 {
+		rec := make([]byte, size)
+		if _, err := io.ReadFull(br, rec); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("truncated record of %d bytes: %w", size, err)
+			}
+			return nil, err
 		}
+		return rec, nil
 	}
 
-	// fmt.Printf("  xs: %v\n", xs)
-	Assert(IsSorted(xs), "input array after merge must be sorted")
+	rec, err := br.ReadBytes('\n')
+	if err == io.EOF && len(rec) > 0 {
+		return rec, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec[:len(rec)-1], nil
 }
 
-// Merges two slices into an output slice using an auxiliary array.
-// out, xs, ys can intersect. Assumes aux doesn't intersect with other arrays.
-//
-// Assumes that:
-//   - out, xs, ys can intersect
-//   - aux doesn't intersect with other arrays
-//   - xs and ys are sorted
-//   - len(out) == len(xs)+len(ys)
-//   - len(aux) >= len(xs)+len(ys)
-func MergeInto2[T cmp.Ordered](out []T, xs []T, ys []T, aux []T) {
-	// fmt.Printf("MergeInto2:\n")
-	// fmt.Printf("  xs: %v\n", xs)
-	// fmt.Printf("  ys: %v\n", ys)
-	// fmt.Printf("  aux: %v\n", aux[:len(out)])
-	// fmt.Printf("  out: %v\n", out)
-	Assert(IsSorted(xs), "xs must be sorted")
-	Assert(IsSorted(ys), "ys must be sorted")
-	Assert(len(out) == len(xs)+len(ys), "out is smaller than xs and ys combined")
-	Assert(len(aux) >= len(out), "aux is smaller than out")
+// Writes a record followed by a newline if records are newline-delimited
+func writeRecord(bw *bufio.Writer, rec []byte, size int) error {
+	if _, err := bw.Write(rec); err != nil {
+		return err
+	}
+	if size == 0 {
+		return bw.WriteByte('\n')
+	}
+	return nil
+}
 
-	lx, ly := len(xs), len(ys)
+// Reads records until the memory budget is exhausted. Returns io.EOF only if there are no records left.
+// Always reads at least one record, so records larger than the budget are supported.
+func readChunk(br *bufio.Reader, opts *ExternalSortOptions, recs [][]byte) ([][]byte, error) {
+	recs = recs[:0]
+	for used := 0; len(recs) == 0 || used < opts.Memory; {
+		rec, err := readRecord(br, opts.RecordSize)
+		if err == io.EOF && len(recs) > 0 {
+			return recs, nil
+		}
+		if err != nil {
+			return recs, err
+		}
+		recs = append(recs, rec)
+		used += len(rec) + externalSortRecordOverhead
+	}
+	return recs, nil
+}
 
-	// Right boundary of aux and out
-	r := lx + ly - 1
+// Writes sorted records into a new temporary file, returns its name
+func writeRun(recs [][]byte, opts *ExternalSortOptions) (name string, err error) {
+	f, err := os.CreateTemp(opts.TempDir, "external-sort-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
 
-	// Copy xs forwards into aux
-	copy(aux, xs)
+	bw := bufio.NewWriterSize(f, externalSortMinBufferSize)
+	for _, rec := range recs {
+		if err = writeRecord(bw, rec, opts.RecordSize); err != nil {
+			return "", err
+		}
+	}
+	return f.Name(), bw.Flush()
+}
 
-	// Copy ys backwards into aux
-	for j := lx; j <= r; j++ {
-		aux[j] = ys[r-j] // r-j = lx + ly - 1 - (lx + offset) = ly - 1 - offset
+// The current record of a run during k-way merge
+type externalSortHead struct {
+	rec []byte
+	run int
+}
+
+// Merges sorted run files into w using a heap of the current records of each run.
+// Ties are resolved by the order of runs.
+func mergeRuns(names []string, w io.Writer, opts *ExternalSortOptions) error {
+	// Split the memory budget between readers of runs
+	size := max(opts.Memory/len(names), externalSortMinBufferSize)
+	readers := make([]*bufio.Reader, len(names))
+	for i, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers[i] = bufio.NewReaderSize(f, size)
 	}
 
-	// k counts total number of elements minus 1 which is r
-	// i starts from the left boundary 0 and goes up to lx-1
-	// j starts from the right boundary r and goes down to lx
-	for k, i, j := 0, 0, r; k <= r; k++ {
-		if cmp.Less(aux[j], aux[i]) {
-			out[k] = aux[j]
-			j--
-		} else {
-			out[k] = aux[i]
-			i++
+	heads := make([]externalSortHead, 0, len(names))
+	for i, rd := range readers {
+		rec, err := readRecord(rd, opts.RecordSize)
+		if err != nil {
+			return err
 		}
+		heads = append(heads, externalSortHead{rec: rec, run: i})
 	}
+	h := NewHeapFunc(heads, func(a, b externalSortHead) int {
+		if c := opts.Cmp(a.rec, b.rec); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.run, b.run)
+	})
+
+	bw := bufio.NewWriterSize(w, externalSortMinBufferSize)
+	for h.Len() > 0 {
+		top := h.Top()
+		if err := writeRecord(bw, top.rec, opts.RecordSize); err != nil {
+			return err
+		}
 
-	// fmt.Printf("  out: %v\n", out)
-	Assert(IsSorted(out), "output array after merge must be sorted")
+		rec, err := readRecord(readers[top.run], opts.RecordSize)
+		if err == io.EOF {
+			h.Pop()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		h.ReplaceTop(externalSortHead{rec: rec, run: top.run})
+	}
+	return bw.Flush()
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 8.2.
-// Uses MergeInto2 to simplify working with slices.
-func TopDownMergeSort[T cmp.Ordered](xs []T, aux []T) {
-	// fmt.Printf("TopDownMergeSort")
-	// fmt.Printf("  xs: %v\n", xs)
-	ln := len(xs)
-	if ln <= 1 {
-		return
+// Merges runs into a new temporary file, returns its name
+func mergeRunsToFile(names []string, opts *ExternalSortOptions) (name string, err error) {
+	f, err := os.CreateTemp(opts.TempDir, "external-sort-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	return f.Name(), mergeRuns(names, f, opts)
+}
+
+// Sorts records read from r using bounded memory and writes them to w.
+// Reads chunks of records fitting into opts.Memory, sorts them using TimSort and writes them as runs
+// into temporary files, then merges runs using a heap, at most externalSortMaxFanIn at once.
+// Ties are resolved by the order of runs, so the sort is stable.
+// Newline-delimited records are written with a trailing newline even if the input lacked it.
+// A carriage return before the newline stays a part of the record, so CRLF line endings are kept.
+func ExternalSort(r io.Reader, w io.Writer, opts ExternalSortOptions) (err error) {
+	if opts.Memory <= 0 {
+		opts.Memory = externalSortDefaultMemory
+	}
+	if opts.Cmp == nil {
+		opts.Cmp = bytes.Compare
 	}
 
-	// Using an index to split an array
+	br := bufio.NewReader(r)
 
-	// m := (ln - 1) / 2 // =(l+r)/2 where l=0, r=len(xs)-1
-	// fmt.Printf("  m: %v\n", m)
-	// TopDownMergeSort(xs[:m+1], aux)
-	// TopDownMergeSort(xs[m+1:], aux)
-	// MergeInside(xs, m, aux)
+	var runs []string
+	defer func() {
+		for _, name := range runs {
+			os.Remove(name)
+		}
+	}()
 
-	// Or using two slices, which looks nicer
+	// Sort chunks and spill them into run files
+	var recs, aux [][]byte
+	for {
+		recs, err = readChunk(br, &opts, recs)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
 
-	m := (ln + 1) / 2 // =1+(ln-1)/2
-	ys, zs := xs[:m], xs[m:]
-	TopDownMergeSort(ys, aux)
-	TopDownMergeSort(zs, aux)
-	MergeInto2(xs, ys, zs, aux)
-}
+		aux = append(aux[:0], recs...)
+		TimSortFunc(recs, aux, opts.Cmp)
+
+		// Everything fits into memory, no need for run files
+		if len(runs) == 0 {
+			if _, err = br.Peek(1); err == io.EOF {
+				bw := bufio.NewWriterSize(w, externalSortMinBufferSize)
+				for _, rec := range recs {
+					if err = writeRecord(bw, rec, opts.RecordSize); err != nil {
+						return err
+					}
+				}
+				return bw.Flush()
+			}
+		}
 
-// Based on Sedgewick, Algorithms in C++, prog. 8.4.
-func topDownMergeSortABImpl[T cmp.Ordered](xs []T, aux []T) {
-	// fmt.Printf("topDownMergeSortABImpl\n  xs:  %v\n  aux: %v\n", xs, aux)
-	ln := len(xs)
-	if ln <= 1 {
-		return
+		var name string
+		if name, err = writeRun(recs, &opts); err != nil {
+			return err
+		}
+		runs = append(runs, name)
+	}
+	if len(runs) == 0 {
+		return nil
 	}
-	// if ln <= 10 {
-	// 	InsertionSort(xs)
-	// 	return
-	// }
 
-	m := (ln + 1) / 2 // =1+(ln-1)/2
+	// Merge consecutive groups of runs until they can be merged at once, this keeps the order of ties
+	for len(runs) > externalSortMaxFanIn {
+		var merged []string
+		for i := 0; i < len(runs); i += externalSortMaxFanIn {
+			group := runs[i:min(i+externalSortMaxFanIn, len(runs))]
+			if len(group) == 1 {
+				merged = append(merged, group[0])
+				continue
+			}
 
-	// Swap aux and xs to prevent copying step in merge routine
-	topDownMergeSortABImpl(aux[:m], xs[:m])
-	topDownMergeSortABImpl(aux[m:], xs[m:])
-	// fmt.Printf("  m:   %v\n  aux[:m]:  %v\n  aux[m:]: %v\n", m, aux[:m], aux[m:])
-	// Swap aux and xs back
-	MergeInto(xs, aux[:m], aux[m:])
-	// fmt.Printf("  xs:   %v\n", xs)
+			var name string
+			if name, err = mergeRunsToFile(group, &opts); err != nil {
+				// Let the deferred cleanup remove both merged and not yet merged runs
+				runs = append(merged, runs[i:]...)
+				return err
+			}
+			for _, g := range group {
+				os.Remove(g)
+			}
+			merged = append(merged, name)
+		}
+		runs = merged
+	}
+
+	return mergeRuns(runs, w, &opts)
 }
 
-// Based on Sedgewick, Algorithms in C++, prog. 8.4.
-func TopDownMergeSortAB[T cmp.Ordered](xs []T, aux []T) {
-	Assert(len(aux) >= len(xs), "aux must have at least the same length as xs")
+// Sorts iters arrays of each of inputDistributions for each length up to 2^pow and checks that they are sorted.
+func TestSort(buf []uint16, fn func(xs []uint16), seed uint16, pow int, iters int) {
+	_, file, line, _ := runtime.Caller(1)
 
-	// We swap aux and xs, so they must contain the same data
-	aux = aux[:len(xs)]
-	copy(aux, xs)
+	nextSeed := seed
+	for p := 0; p <= pow; p++ {
+		length := 1 << p
+		xs := buf[:length]
 
-	topDownMergeSortABImpl(xs, aux)
+		for _, d := range inputDistributions {
+			for i := 0; i < iters; i++ {
+				initialSeed := nextSeed
+				nextSeed = d.fill(xs, initialSeed)
+				// fmt.Printf("  seed:   %v\n", initialSeed)
+				// fmt.Printf("  before: %v\n", xs)
+				fn(xs)
+				// fmt.Printf("  after:  %v\n", xs)
+				// fmt.Println("  sorted:", IsSorted(xs))
+				if !IsSorted(xs) {
+					fmt.Printf("%s failed for %s len=%d, seed=%d at %s:%d\n", GetFunctionName(fn), d.name, length, initialSeed, file, line)
+					return
+				}
+			}
+		}
+	}
 }
 
-func BottomUpMergeSort[T cmp.Ordered](xs []T, aux []T) {
-	ln := len(xs)
-	for m := 1; m < ln; m += m {
-		for i := 0; i <= ln-m; i += m + m {
-			r := min(i+m+m, ln)
-			MergeInto2(xs[i:r], xs[i:i+m], xs[i+m:r], aux)
+// Like TestSort, but instruments fn and prints average counts of its operations for each length and distribution.
+func TestSortStats(buf []uint16, fn func(xs []uint16, cmp func(a, b uint16) int), seed uint16, pow int, iters int) {
+	_, file, line, _ := runtime.Caller(1)
+
+	nextSeed := seed
+	for p := 0; p <= pow; p++ {
+		length := 1 << p
+		xs := buf[:length]
+
+		for _, d := range inputDistributions {
+			var total SortStats
+			for i := 0; i < iters; i++ {
+				initialSeed := nextSeed
+				nextSeed = d.fill(xs, initialSeed)
+				stats := Instrument(cmp.Compare[uint16], func(cmp func(a, b uint16) int) { fn(xs, cmp) })
+				if !IsSorted(xs) {
+					fmt.Printf("%s failed for %s len=%d, seed=%d at %s:%d\n", GetFunctionName(fn), d.name, length, initialSeed, file, line)
+					return
+				}
+				total.Comparisons += stats.Comparisons
+				total.Exchanges += stats.Exchanges
+				total.Moves += stats.Moves
+				total.MaxDepth = max(total.MaxDepth, stats.MaxDepth)
+			}
+
+			fmt.Printf("%s %s len=%d: comparisons=%d, exchanges=%d, moves=%d, max depth=%d\n", GetFunctionName(fn), d.name, length,
+				total.Comparisons/iters, total.Exchanges/iters, total.Moves/iters, total.MaxDepth)
 		}
 	}
 }
 
-func TestSort(buf []uint16, fn func(xs []uint16), seed uint16, pow int, iters int) {
+// Element for stability checks: elements are compared by Key only, Index is the original position
+type KeyIndex struct {
+	Key   uint16
+	Index int
+}
+
+func CompareKeyIndex(a, b KeyIndex) int {
+	return cmp.Compare(a.Key, b.Key)
+}
+
+// Few distinct keys, so that there are many equal elements to reorder
+const stabilityTestKeys = 8
+
+// Like TestSort, but also checks that elements with equal keys keep their original order.
+func TestStability(buf []KeyIndex, fn func(xs []KeyIndex, cmp func(a, b KeyIndex) int), seed uint16, pow int, iters int) {
 	_, file, line, _ := runtime.Caller(1)
 
 	nextSeed := seed
@@ -550,14 +3719,22 @@ func TestSort(buf []uint16, fn func(xs []uint16), seed uint16, pow int, iters in
 
 		for i := 0; i < iters; i++ {
 			initialSeed := nextSeed
-			nextSeed = FillUint16Array(xs, initialSeed)
-			// fmt.Printf("  seed:   %v\n", initialSeed)
-			// fmt.Printf("  before: %v\n", xs)
-			fn(xs)
-			// fmt.Printf("  after:  %v\n", xs)
-			// fmt.Println("  sorted:", IsSorted(xs))
-			if !IsSorted(xs) {
-				fmt.Printf("%s failed for len=%d, seed=%d at %s:%d\n", GetFunctionName(fn), length, initialSeed, file, line)
+			for j := range xs {
+				nextSeed = XorShift16(nextSeed)
+				xs[j] = KeyIndex{Key: nextSeed % stabilityTestKeys, Index: j}
+			}
+			nextSeed = XorShift16(nextSeed)
+
+			fn(xs, CompareKeyIndex)
+
+			stable := IsSortedFunc(xs, func(a, b KeyIndex) int {
+				if c := CompareKeyIndex(a, b); c != 0 {
+					return c
+				}
+				return cmp.Compare(a.Index, b.Index)
+			})
+			if !stable {
+				fmt.Printf("%s is not stable for len=%d, seed=%d at %s:%d\n", GetFunctionName(fn), length, initialSeed, file, line)
 				return
 			}
 		}
@@ -582,24 +3759,55 @@ func TestSelect(buf []uint16, fn func(xs []uint16, k int), seed uint16, pow int,
 		length := 1 << p
 		xs := buf[:length]
 
-		for i := 0; i < iters; i++ {
-			initialSeed := nextSeed
-			nextSeed = FillUint16Array(xs, initialSeed)
-			nextSeed = XorShift16(nextSeed)
-			k := int(float32(len(xs)) * float32(nextSeed) / float32(1<<16))
-			nextSeed = XorShift16(nextSeed)
-			// fmt.Printf("  seed:   %v\n", initialSeed)
-			// fmt.Printf("  k:      %v of %v\n", k, len(xs))
-			// fmt.Printf("  before: %v\n", xs)
-			fn(xs, k)
-			// fmt.Printf("  after:  %v\n", xs)
-			partitionedLeft := All(xs[:k], func(x uint16) bool { return x <= xs[k] })
-			partitionedRight := All(xs[k+1:], func(x uint16) bool { return x >= xs[k] })
-			// fmt.Println("  sorted:", partitionedLeft, partitionedRight)
-			if !partitionedLeft || !partitionedRight {
-				fmt.Printf("%s failed for len=%d, seed=%d, k=%d at %s:%d\n", GetFunctionName(fn), length, initialSeed, k, file, line)
+		for _, d := range inputDistributions {
+			for i := 0; i < iters; i++ {
+				initialSeed := nextSeed
+				nextSeed = d.fill(xs, initialSeed)
+				nextSeed = XorShift16(nextSeed)
+				k := int(float32(len(xs)) * float32(nextSeed) / float32(1<<16))
+				nextSeed = XorShift16(nextSeed)
+				// fmt.Printf("  seed:   %v\n", initialSeed)
+				// fmt.Printf("  k:      %v of %v\n", k, len(xs))
+				// fmt.Printf("  before: %v\n", xs)
+				fn(xs, k)
+				// fmt.Printf("  after:  %v\n", xs)
+				partitionedLeft := All(xs[:k], func(x uint16) bool { return x <= xs[k] })
+				partitionedRight := All(xs[k+1:], func(x uint16) bool { return x >= xs[k] })
+				// fmt.Println("  sorted:", partitionedLeft, partitionedRight)
+				if !partitionedLeft || !partitionedRight {
+					fmt.Printf("%s failed for %s len=%d, seed=%d, k=%d at %s:%d\n", GetFunctionName(fn), d.name, length, initialSeed, k, file, line)
+					return
+				}
+			}
+		}
+	}
+}
+
+// Sorts inputs built by AntiQuickSort for fn and by MedianOfThreeKiller for each length up to 2^pow,
+// checks that they are sorted and prints how many comparisons fn made relative to n*log2(n).
+// Hardened sorts stay within a small multiple of n*log2(n), quadratic ones grow with n.
+func TestAdversary(fn func(xs []int, cmp func(a, b int) int), pow int) {
+	_, file, line, _ := runtime.Caller(1)
+
+	for p := 1; p <= pow; p++ {
+		length := 1 << p
+		anti, _ := AntiQuickSort(length, fn)
+		killers := []struct {
+			name string
+			xs   []int
+		}{
+			{"antiquicksort", anti},
+			{"median-of-3 killer", MedianOfThreeKiller(length)},
+		}
+
+		for _, k := range killers {
+			stats := Instrument(cmp.Compare[int], func(cmp func(a, b int) int) { fn(k.xs, cmp) })
+			if !IsSorted(k.xs) {
+				fmt.Printf("%s failed for %s len=%d at %s:%d\n", GetFunctionName(fn), k.name, length, file, line)
 				return
 			}
+			fmt.Printf("%s %s len=%d: comparisons=%d (%.1f n log n)\n", GetFunctionName(fn), k.name, length,
+				stats.Comparisons, float64(stats.Comparisons)/float64(length*p))
 		}
 	}
 }
@@ -611,6 +3819,9 @@ func main() {
 	// fmt.Printf("%v\n", ys)
 	// return
 
+	flag.BoolVar(&MergeDebugChecks, "merge.debug", false, "check merge invariants on every merge, which is slow")
+	flag.Parse()
+
 	pow := 12
 	buf := make([]uint16, 1<<pow)
 	aux := make([]uint16, 1<<pow)
@@ -623,26 +3834,71 @@ func main() {
 	// 	fmt.Printf("a: %v\n", xs)
 	// 	BottomUpMergeSort(xs, aux)
 	// 	fmt.Printf("b: %v\n", xs)
-	// 	Assert(IsSorted(xs), "not sorted")
+	// 	fmt.Println("sorted:", IsSorted(xs))
 	// }
 	// return
 
+	// TestSortStats(buf, QuickSortFunc, 1, pow, 100)
+	// TestSortStats(buf, ShellSortFunc, 1, pow, 100)
+	// TestAdversary(QuickSortFunc, pow)
+	// TestAdversary(HybridQuickSortFunc, pow)
+	// TestAdversary(PdqSortFunc, pow)
 	// TestSort(buf, InsertionSort, 1, pow, 100)
 	// TestSort(buf, SelectionSort, 1, pow, 100)
 	// TestSort(buf, InsertionSort2, 1, pow, 100)
 	// TestSort(buf, BubbleSort, 1, pow, 100)
 	// TestSort(buf, BubbleSort2, 1, pow, 100)
 	// TestSort(buf, ShellSort, 1, pow, 100)
+	// TestSort(buf, func(xs []uint16) { ShellSortWithGaps(xs, CiuraGaps) }, 1, pow, 100)
+	// TestSort(buf, func(xs []uint16) { ShellSortWithGaps(xs, PrattGaps) }, 1, pow, 100)
+	// ShellSortGapsReport(os.Stdout, buf, 1, pow, 100)
+	// TestSort(buf, NetworkSort, 1, pow, 10000)
+	// TestSort(buf, OddEvenMergeSort, 1, pow, 10000)
+	// TestSort(buf, BitonicSort, 1, pow, 10000)
+	// TestSort(buf, NetworkSortInteger, 1, pow, 10000)
+	// TestSort(buf, OddEvenMergeSortInteger, 1, pow, 10000)
+	// TestSort(buf, BitonicSortInteger, 1, pow, 10000)
+	// TestSort(buf, CountSort, 1, pow, 100)
+	// TestSort(buf, BucketSort, 1, pow, 100)
+	// TestSort(buf, func(xs []uint16) { BucketSortWith(xs, 16, ShellSort) }, 1, pow, 100)
+	// TestSort(buf, func(xs []uint16) { LSDRadixSort(xs, aux) }, 1, pow, 10000)
+	// TestSort(buf, MSDRadixSort, 1, pow, 10000)
+	// TestSort(buf, HeapSort, 1, pow, 10000)
 	// TestSort(buf, QuickSort, 1, pow, 10000)
 	// TestSort(buf, NonRecursiveQuickSort, 1, pow, 10000)
 	// TestSort(buf, HybridQuickSort, 1, pow, 10000)
+	// TestSort(buf, ThreeWayQuickSort, 1, pow, 10000)
+	// TestSort(buf, PdqSort, 1, pow, 10000)
+	// TestSort(buf, ParallelQuickSort, 1, pow, 10000)
+	// TestSort(buf, func(xs []uint16) { SampleSort(xs, aux) }, 1, pow, 10000)
 	// TestSelect(buf, Select, 1, pow, 10000)
 	// TestSelect(buf, NonRecursiveSelect, 1, pow, 10000)
+	// TestSelect(buf, MedianOfMediansSelect, 1, pow, 10000)
+	// TestSelect(buf, FloydRivestSelect, 1, pow, 10000)
+	// TestSelect(buf, IntroSelect, 1, pow, 10000)
+	// TestSelect(buf, PartialSort, 1, pow, 10000)
 	// TestSort(buf, func(xs []uint16) { TopDownMergeSort(xs, aux) }, 1, pow, 10000)
 	// TestSort(buf, func(xs []uint16) { TopDownMergeSortAB(xs, aux) }, 1, pow, 10000)
 	TestSort(buf, func(xs []uint16) { BottomUpMergeSort(xs, aux) }, 1, pow, 10000)
-
-	// TestSort(buf, CountSort, 1, pow, 100) // TODO:
-	// TestSort(buf, BucketSort, 1, pow, 100) // TODO:
-	// TestSort(buf, ThreeWayQuickSort, 1, pow, 10000) // TODO:
+	// TestSort(buf, InPlaceMergeSort, 1, pow, 10000)
+	// TestSort(buf, func(xs []uint16) { TimSort(xs, aux) }, 1, pow, 10000)
+	// TestSort(buf, func(xs []uint16) { ParallelMergeSort(xs, aux) }, 1, pow, 10000)
+
+	// kbuf := make([]KeyIndex, 1<<pow)
+	// kaux := make([]KeyIndex, 1<<pow)
+	// TestStability(kbuf, InsertionSortFunc, 1, pow, 100)
+	// TestStability(kbuf, InsertionSort2Func, 1, pow, 100)
+	// TestStability(kbuf, BubbleSortFunc, 1, pow, 100)
+	// TestStability(kbuf, BubbleSort2Func, 1, pow, 100)
+	// TestStability(kbuf, func(xs []KeyIndex, cmp func(a, b KeyIndex) int) { TopDownMergeSortFunc(xs, kaux, cmp) }, 1, pow, 1000)
+	// TestStability(kbuf, func(xs []KeyIndex, cmp func(a, b KeyIndex) int) { TopDownMergeSortABFunc(xs, kaux, cmp) }, 1, pow, 1000)
+	// TestStability(kbuf, func(xs []KeyIndex, cmp func(a, b KeyIndex) int) { BottomUpMergeSortFunc(xs, kaux, cmp) }, 1, pow, 1000)
+	// TestStability(kbuf, InPlaceMergeSortFunc, 1, pow, 1000)
+	// TestStability(kbuf, func(xs []KeyIndex, cmp func(a, b KeyIndex) int) { TimSortFunc(xs, kaux, cmp) }, 1, pow, 1000)
+	// TestStability(kbuf, func(xs []KeyIndex, cmp func(a, b KeyIndex) int) { ParallelMergeSortFunc(xs, kaux, 0, cmp) }, 1, pow, 1000)
+
+	// if err := ExternalSort(os.Stdin, os.Stdout, ExternalSortOptions{}); err != nil {
+	// 	fmt.Fprintln(os.Stderr, err)
+	// 	os.Exit(1)
+	// }
 }
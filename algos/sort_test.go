@@ -0,0 +1,1439 @@
+// Tests for sort.go. Other files in this directory are separate programs, so pass the files explicitly:
+//
+//	go test sort.go sort_test.go
+//	go test -fuzz FuzzSort sort.go sort_test.go
+//	go test -run XXX -bench 'Sorts/int/PdqSort/uniform/' sort.go sort_test.go
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"math/bits"
+	"os"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Lengths of inputs sorted by the table-driven tests: all small ones, powers of two and their neighbours
+var testLengths = []int{
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 23, 24, 25, 31, 32, 33,
+	63, 64, 65, 127, 128, 129, 255, 256, 257, 1000, 1023, 1024, 1025, 1500,
+}
+
+// Number of inputs of each length and distribution sorted by the table-driven tests
+const testIters = 2
+
+// Inputs longer than this are truncated by the fuzz targets, so that quadratic sorts keep up
+const fuzzMaxLength = 1 << 11
+
+// Sorts by ExternalSort with small memory, so that it goes through run files
+func externalSortUint16(xs []uint16) {
+	in := make([]byte, 2*len(xs))
+	for i, x := range xs {
+		binary.BigEndian.PutUint16(in[2*i:], x)
+	}
+
+	var out bytes.Buffer
+	opts := ExternalSortOptions{RecordSize: 2, Memory: 32 * (2 + externalSortRecordOverhead)}
+	if err := ExternalSort(bytes.NewReader(in), &out, opts); err != nil {
+		panic(err)
+	}
+
+	for i := range xs {
+		xs[i] = binary.BigEndian.Uint16(out.Bytes()[2*i:])
+	}
+}
+
+// All sorts, aux is as long as xs
+var sortTests = []struct {
+	name string
+	sort func(xs, aux []uint16)
+}{
+	{"InsertionSort", func(xs, _ []uint16) { InsertionSort(xs) }},
+	{"InsertionSort2", func(xs, _ []uint16) { InsertionSort2(xs) }},
+	{"SelectionSort", func(xs, _ []uint16) { SelectionSort(xs) }},
+	{"BubbleSort", func(xs, _ []uint16) { BubbleSort(xs) }},
+	{"BubbleSort2", func(xs, _ []uint16) { BubbleSort2(xs) }},
+	{"ShellSort", func(xs, _ []uint16) { ShellSort(xs) }},
+	{"ShellSortWithGaps/Ciura", func(xs, _ []uint16) { ShellSortWithGaps(xs, CiuraGaps) }},
+	{"ShellSortWithGaps/Sedgewick1986", func(xs, _ []uint16) { ShellSortWithGaps(xs, Sedgewick1986Gaps) }},
+	{"ShellSortWithGaps/Tokuda", func(xs, _ []uint16) { ShellSortWithGaps(xs, TokudaGaps) }},
+	{"ShellSortWithGaps/Pratt", func(xs, _ []uint16) { ShellSortWithGaps(xs, PrattGaps) }},
+	{"ShellSortWithGaps/Hibbard", func(xs, _ []uint16) { ShellSortWithGaps(xs, HibbardGaps) }},
+	{"NetworkSort", func(xs, _ []uint16) { NetworkSort(xs) }},
+	{"OddEvenMergeSort", func(xs, _ []uint16) { OddEvenMergeSort(xs) }},
+	{"BitonicSort", func(xs, _ []uint16) { BitonicSort(xs) }},
+	{"NetworkSortInteger", func(xs, _ []uint16) { NetworkSortInteger(xs) }},
+	{"OddEvenMergeSortInteger", func(xs, _ []uint16) { OddEvenMergeSortInteger(xs) }},
+	{"BitonicSortInteger", func(xs, _ []uint16) { BitonicSortInteger(xs) }},
+	{"CountSort", func(xs, _ []uint16) { CountSort(xs) }},
+	{"BucketSort", func(xs, _ []uint16) { BucketSort(xs) }},
+	{"BucketSortWith", func(xs, _ []uint16) { BucketSortWith(xs, 16, ShellSort[uint16]) }},
+	{"LSDRadixSort", LSDRadixSort[uint16]},
+	{"MSDRadixSort", func(xs, _ []uint16) { MSDRadixSort(xs) }},
+	{"QuickSort", func(xs, _ []uint16) { QuickSort(xs) }},
+	{"NonRecursiveQuickSort", func(xs, _ []uint16) { NonRecursiveQuickSort(xs) }},
+	{"HybridQuickSort", func(xs, _ []uint16) { HybridQuickSort(xs) }},
+	{"ThreeWayQuickSort", func(xs, _ []uint16) { ThreeWayQuickSort(xs) }},
+	{"PdqSort", func(xs, _ []uint16) { PdqSort(xs) }},
+	{"TopDownMergeSort", TopDownMergeSort[uint16]},
+	{"TopDownMergeSortAB", TopDownMergeSortAB[uint16]},
+	{"BottomUpMergeSort", BottomUpMergeSort[uint16]},
+	{"InPlaceMergeSort", func(xs, _ []uint16) { InPlaceMergeSort(xs) }},
+	{"TimSort", TimSort[uint16]},
+	{"ParallelMergeSort", func(xs, aux []uint16) { ParallelMergeSortFunc(xs, aux, 4, cmp.Compare[uint16]) }},
+	{"ParallelQuickSort", func(xs, _ []uint16) { ParallelQuickSortFunc(xs, 4, cmp.Compare[uint16]) }},
+	{"SampleSort", func(xs, aux []uint16) { SampleSortFunc(xs, aux, 4, cmp.Compare[uint16]) }},
+	{"HeapSort", func(xs, _ []uint16) { HeapSort(xs) }},
+	{"ExternalSort", func(xs, _ []uint16) { externalSortUint16(xs) }},
+}
+
+// Sorts specific to Integer types, aux is as long as xs.
+// TestSignedSorts instantiates them for signed types, which sortTests doesn't cover.
+func integerSortTests[T Integer]() []struct {
+	name string
+	sort func(xs, aux []T)
+} {
+	return []struct {
+		name string
+		sort func(xs, aux []T)
+	}{
+		{"CountSort", func(xs, _ []T) { CountSort(xs) }},
+		{"BucketSort", func(xs, _ []T) { BucketSort(xs) }},
+		{"BucketSortWith", func(xs, _ []T) { BucketSortWith(xs, 16, ShellSort[T]) }},
+		{"LSDRadixSort", LSDRadixSort[T]},
+		{"MSDRadixSort", func(xs, _ []T) { MSDRadixSort(xs) }},
+		{"NetworkSortInteger", func(xs, _ []T) { NetworkSortInteger(xs) }},
+		{"OddEvenMergeSortInteger", func(xs, _ []T) { OddEvenMergeSortInteger(xs) }},
+		{"BitonicSortInteger", func(xs, _ []T) { BitonicSortInteger(xs) }},
+	}
+}
+
+// Stable sorts, aux is as long as xs
+var stableSortTests = []struct {
+	name string
+	sort func(xs, aux []KeyIndex, cmp func(a, b KeyIndex) int)
+}{
+	{"InsertionSort", func(xs, _ []KeyIndex, cmp func(a, b KeyIndex) int) { InsertionSortFunc(xs, cmp) }},
+	{"InsertionSort2", func(xs, _ []KeyIndex, cmp func(a, b KeyIndex) int) { InsertionSort2Func(xs, cmp) }},
+	{"BubbleSort", func(xs, _ []KeyIndex, cmp func(a, b KeyIndex) int) { BubbleSortFunc(xs, cmp) }},
+	{"BubbleSort2", func(xs, _ []KeyIndex, cmp func(a, b KeyIndex) int) { BubbleSort2Func(xs, cmp) }},
+	{"TopDownMergeSort", TopDownMergeSortFunc[KeyIndex]},
+	{"TopDownMergeSortAB", TopDownMergeSortABFunc[KeyIndex]},
+	{"BottomUpMergeSort", BottomUpMergeSortFunc[KeyIndex]},
+	{"InPlaceMergeSort", func(xs, _ []KeyIndex, cmp func(a, b KeyIndex) int) { InPlaceMergeSortFunc(xs, cmp) }},
+	{"TimSort", TimSortFunc[KeyIndex]},
+	{"ParallelMergeSort", func(xs, aux []KeyIndex, cmp func(a, b KeyIndex) int) { ParallelMergeSortFunc(xs, aux, 4, cmp) }},
+}
+
+// All selection algorithms
+var selectTests = []struct {
+	name string
+	sel  func(xs []uint16, k int)
+}{
+	{"Select", Select[uint16]},
+	{"NonRecursiveSelect", NonRecursiveSelect[uint16]},
+	{"MedianOfMediansSelect", MedianOfMediansSelect[uint16]},
+	{"FloydRivestSelect", FloydRivestSelect[uint16]},
+	{"IntroSelect", IntroSelect[uint16]},
+	{"PartialSort", PartialSort[uint16]},
+}
+
+// All merges of two sorted slices, return the merged slice
+var mergeTests = []struct {
+	name  string
+	merge func(xs, ys []KeyIndex) []KeyIndex
+}{
+	{"MergeInto", func(xs, ys []KeyIndex) []KeyIndex {
+		out := make([]KeyIndex, len(xs)+len(ys))
+		MergeIntoFunc(out, xs, ys, CompareKeyIndex)
+		return out
+	}},
+	{"MergeInside", func(xs, ys []KeyIndex) []KeyIndex {
+		out := slices.Concat(xs, ys)
+		MergeInsideFunc(out, len(xs)-1, make([]KeyIndex, len(out)), CompareKeyIndex)
+		return out
+	}},
+	{"MergeInto2", func(xs, ys []KeyIndex) []KeyIndex {
+		out := make([]KeyIndex, len(xs)+len(ys))
+		MergeInto2Func(out, xs, ys, make([]KeyIndex, len(out)), CompareKeyIndex)
+		return out
+	}},
+	{"InPlaceMerge", func(xs, ys []KeyIndex) []KeyIndex {
+		out := slices.Concat(xs, ys)
+		InPlaceMergeFunc(out, len(xs)-1, CompareKeyIndex)
+		return out
+	}},
+	{"MergeK", func(xs, ys []KeyIndex) []KeyIndex {
+		out := make([]KeyIndex, len(xs)+len(ys))
+		MergeKFunc(out, [][]KeyIndex{xs, nil, ys}, CompareKeyIndex)
+		return out
+	}},
+	{"MergeSeq", func(xs, ys []KeyIndex) []KeyIndex {
+		return slices.Collect(MergeSeqFunc([]iter.Seq[KeyIndex]{slices.Values(xs), slices.Values(ys)}, CompareKeyIndex))
+	}},
+	{"MergeChan", func(xs, ys []KeyIndex) []KeyIndex {
+		var out []KeyIndex
+		for x := range MergeChanFunc(nil, []<-chan KeyIndex{sliceChan(xs), sliceChan(ys)}, CompareKeyIndex) {
+			out = append(out, x)
+		}
+		return out
+	}},
+}
+
+func sliceChan[T any](xs []T) <-chan T {
+	ch := make(chan T)
+	go func() {
+		defer close(ch)
+		for _, x := range xs {
+			ch <- x
+		}
+	}()
+	return ch
+}
+
+// Checks that xs is input sorted, which means both that it's sorted and that it has the same elements
+func checkSorted(t *testing.T, input, xs []uint16, format string, args ...any) {
+	t.Helper()
+	want := slices.Clone(input)
+	slices.Sort(want)
+	if !IsSorted(xs) {
+		t.Fatalf(format+": output is not sorted", args...)
+	}
+	if !slices.Equal(xs, want) {
+		t.Fatalf(format+": output is not a permutation of input", args...)
+	}
+}
+
+// Checks that xs[k] is the k-th smallest element of input, smaller elements precede it and greater ones follow it
+func checkSelected(t *testing.T, input, xs []uint16, k int, format string, args ...any) {
+	t.Helper()
+	want := slices.Clone(input)
+	slices.Sort(want)
+	if xs[k] != want[k] ||
+		!All(xs[:k], func(x uint16) bool { return x <= xs[k] }) ||
+		!All(xs[k+1:], func(x uint16) bool { return x >= xs[k] }) {
+		t.Fatalf(format+": output is not partitioned around the k-th element", args...)
+	}
+	if got := slices.Sorted(slices.Values(xs)); !slices.Equal(got, want) {
+		t.Fatalf(format+": output is not a permutation of input", args...)
+	}
+}
+
+// Calls fn with every length from testLengths, input distribution and seed chained like TestSort does
+func forEachInput(fn func(xs []uint16, dist string, seed uint16)) {
+	buf := make([]uint16, slices.Max(testLengths))
+	nextSeed := uint16(1)
+	for _, length := range testLengths {
+		xs := buf[:length]
+		for _, d := range inputDistributions {
+			for i := 0; i < testIters; i++ {
+				seed := nextSeed
+				nextSeed = d.fill(xs, seed)
+				fn(xs, d.name, seed)
+			}
+		}
+	}
+}
+
+// Lengths of benchmarked inputs are powers of two in this range
+const (
+	sortBenchmarkMinPow = 4
+	sortBenchmarkMaxPow = 24
+)
+
+// Inputs shorter than this are sorted in batches of about this many elements between stops of the timer
+const sortBenchmarkBatchLength = 1 << 16
+
+// Quadratic sorts are benchmarked on inputs up to 2^sortBenchmarkQuadraticMaxPow long
+const sortBenchmarkQuadraticMaxPow = 14
+
+// Strings take more memory, so they are benchmarked on inputs up to 2^sortBenchmarkStringMaxPow long
+const sortBenchmarkStringMaxPow = 20
+
+// A sort in the benchmark suite, aux is as long as xs
+type sortBenchmark[T any] struct {
+	name string
+	sort func(xs, aux []T, cmp func(a, b T) int)
+	// Longest benchmarked input is 2^maxPow, 0 means sortBenchmarkMaxPow
+	maxPow int
+}
+
+// Comparison sorts, Ordered sorts call their Func variants with cmp.Compare, so they are benchmarked through them
+func comparisonSortBenchmarks[T cmp.Ordered]() []sortBenchmark[T] {
+	q := sortBenchmarkQuadraticMaxPow
+	return []sortBenchmark[T]{
+		{name: "InsertionSort", sort: func(xs, _ []T, cmp func(a, b T) int) { InsertionSortFunc(xs, cmp) }, maxPow: q},
+		{name: "InsertionSort2", sort: func(xs, _ []T, cmp func(a, b T) int) { InsertionSort2Func(xs, cmp) }, maxPow: q},
+		{name: "SelectionSort", sort: func(xs, _ []T, cmp func(a, b T) int) { SelectionSortFunc(xs, cmp) }, maxPow: q},
+		{name: "BubbleSort", sort: func(xs, _ []T, cmp func(a, b T) int) { BubbleSortFunc(xs, cmp) }, maxPow: q},
+		{name: "BubbleSort2", sort: func(xs, _ []T, cmp func(a, b T) int) { BubbleSort2Func(xs, cmp) }, maxPow: q},
+		{name: "ShellSort", sort: func(xs, _ []T, cmp func(a, b T) int) { ShellSortFunc(xs, cmp) }},
+		{name: "ShellSortCiura", sort: func(xs, _ []T, cmp func(a, b T) int) { ShellSortWithGapsFunc(xs, CiuraGaps, cmp) }},
+		{name: "OddEvenMergeSort", sort: func(xs, _ []T, cmp func(a, b T) int) { OddEvenMergeSortFunc(xs, cmp) }},
+		{name: "BitonicSort", sort: func(xs, _ []T, cmp func(a, b T) int) { BitonicSortFunc(xs, cmp) }},
+		{name: "QuickSort", sort: func(xs, _ []T, cmp func(a, b T) int) { QuickSortFunc(xs, cmp) }, maxPow: q},
+		{name: "NonRecursiveQuickSort", sort: func(xs, _ []T, cmp func(a, b T) int) { NonRecursiveQuickSortFunc(xs, cmp) }, maxPow: q},
+		{name: "HybridQuickSort", sort: func(xs, _ []T, cmp func(a, b T) int) { HybridQuickSortFunc(xs, cmp) }},
+		{name: "ThreeWayQuickSort", sort: func(xs, _ []T, cmp func(a, b T) int) { ThreeWayQuickSortFunc(xs, cmp) }, maxPow: q},
+		{name: "PdqSort", sort: func(xs, _ []T, cmp func(a, b T) int) { PdqSortFunc(xs, cmp) }},
+		{name: "HeapSort", sort: func(xs, _ []T, cmp func(a, b T) int) { HeapSortFunc(xs, cmp) }},
+		{name: "TopDownMergeSort", sort: TopDownMergeSortFunc[T]},
+		{name: "TopDownMergeSortAB", sort: TopDownMergeSortABFunc[T]},
+		{name: "BottomUpMergeSort", sort: BottomUpMergeSortFunc[T]},
+		{name: "InPlaceMergeSort", sort: func(xs, _ []T, cmp func(a, b T) int) { InPlaceMergeSortFunc(xs, cmp) }},
+		{name: "TimSort", sort: TimSortFunc[T]},
+		{name: "ParallelMergeSort", sort: func(xs, aux []T, cmp func(a, b T) int) { ParallelMergeSortFunc(xs, aux, 0, cmp) }},
+		{name: "ParallelQuickSort", sort: func(xs, _ []T, cmp func(a, b T) int) { ParallelQuickSortFunc(xs, 0, cmp) }},
+		{name: "SampleSort", sort: func(xs, aux []T, cmp func(a, b T) int) { SampleSortFunc(xs, aux, 0, cmp) }},
+	}
+}
+
+// Integer sorts don't compare elements, so they report no comparisons
+func integerSortBenchmarks[T Integer]() []sortBenchmark[T] {
+	return []sortBenchmark[T]{
+		{name: "CountSort", sort: func(xs, _ []T, _ func(a, b T) int) { CountSort(xs) }},
+		{name: "BucketSort", sort: func(xs, _ []T, _ func(a, b T) int) { BucketSort(xs) }},
+		{name: "LSDRadixSort", sort: func(xs, aux []T, _ func(a, b T) int) { LSDRadixSort(xs, aux) }},
+		{name: "MSDRadixSort", sort: func(xs, _ []T, _ func(a, b T) int) { MSDRadixSort(xs) }},
+	}
+}
+
+// A single benchmark of the suite: one sort, element type, input distribution and length
+type sortBenchmarkCase struct {
+	algorithm, elem, dist string
+	n                     int
+	run                   func(b *testing.B)
+}
+
+func (c sortBenchmarkCase) name() string {
+	return fmt.Sprintf("%s/%s/%s/n=%d", c.elem, c.algorithm, c.dist, c.n)
+}
+
+// Appends benchmarks of sorts on elements of type T converted from inputDistributions, inputs are generated when run
+func appendSortBenchmarkCases[T cmp.Ordered](cases []sortBenchmarkCase, elem string, convert func(x uint16) T, sorts []sortBenchmark[T], minPow, maxPow int) []sortBenchmarkCase {
+	for _, sb := range sorts {
+		for p := minPow; p <= min(maxPow, cmp.Or(sb.maxPow, sortBenchmarkMaxPow)); p++ {
+			for _, d := range inputDistributions {
+				n := 1 << p
+				cases = append(cases, sortBenchmarkCase{sb.name, elem, d.name, n, func(b *testing.B) {
+					buf := make([]uint16, n)
+					d.fill(buf, 1)
+					input := make([]T, n)
+					for i, x := range buf {
+						input[i] = convert(x)
+					}
+					// Short inputs are copied and sorted in batches, so that stopping the timer doesn't outweigh sorting
+					batch := max(1, sortBenchmarkBatchLength/n)
+					xss, aux := make([][]T, batch), make([]T, n)
+					for i := range xss {
+						xss[i] = make([]T, n)
+					}
+
+					// Comparisons are counted on a separate run, so that counting doesn't affect the time
+					copy(xss[0], input)
+					stats := Instrument(cmp.Compare[T], func(cmp func(a, b T) int) { sb.sort(xss[0], aux, cmp) })
+
+					compare := cmp.Compare[T]
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i += batch {
+						b.StopTimer()
+						xss := xss[:min(batch, b.N-i)]
+						for _, xs := range xss {
+							copy(xs, input)
+						}
+						b.StartTimer()
+						for _, xs := range xss {
+							sb.sort(xs, aux, compare)
+						}
+					}
+
+					// Reported after ResetTimer, which discards metrics
+					b.ReportMetric(float64(stats.Comparisons), "cmps/op")
+				}})
+			}
+		}
+	}
+	return cases
+}
+
+// Benchmarks of all sorts on uint16, int, float64 and string elements, for each input distribution
+// and lengths from 2^minPow to 2^maxPow. Elements are converted from uint16, so there are at most 2^16 distinct ones.
+func sortBenchmarkCases(minPow, maxPow int) []sortBenchmarkCase {
+	var cases []sortBenchmarkCase
+	cases = appendSortBenchmarkCases(cases, "uint16", func(x uint16) uint16 { return x },
+		append(comparisonSortBenchmarks[uint16](), integerSortBenchmarks[uint16]()...), minPow, maxPow)
+	cases = appendSortBenchmarkCases(cases, "int", func(x uint16) int { return int(x) },
+		append(comparisonSortBenchmarks[int](), integerSortBenchmarks[int]()...), minPow, maxPow)
+	cases = appendSortBenchmarkCases(cases, "float64", func(x uint16) float64 { return float64(x) },
+		comparisonSortBenchmarks[float64](), minPow, maxPow)
+	// Zero-padded, so that strings compare like numbers
+	cases = appendSortBenchmarkCases(cases, "string", func(x uint16) string { return fmt.Sprintf("%05d", x) },
+		comparisonSortBenchmarks[string](), minPow, min(maxPow, sortBenchmarkStringMaxPow))
+	return cases
+}
+
+// Runs benchmarks from sortBenchmarkCases with names matching filter and writes their ns/op, allocations
+// and comparisons per op to w as a "csv" or "markdown" table.
+func sortBenchmarkReport(w io.Writer, format string, filter *regexp.Regexp, minPow, maxPow int) error {
+	header := []string{"algorithm", "type", "distribution", "n", "ns/op", "allocs/op", "B/op", "cmps/op"}
+	var row func(cells []string)
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		defer cw.Flush()
+		row = func(cells []string) { cw.Write(cells) }
+	case "markdown":
+		row = func(cells []string) { fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | ")) }
+	default:
+		return fmt.Errorf("unknown format %q, want csv or markdown", format)
+	}
+
+	row(header)
+	if format == "markdown" {
+		row([]string{"---", "---", "---", "---:", "---:", "---:", "---:", "---:"})
+	}
+	for _, c := range sortBenchmarkCases(minPow, maxPow) {
+		if filter != nil && !filter.MatchString(c.name()) {
+			continue
+		}
+		r := testing.Benchmark(c.run)
+		cmps := "-"
+		if v, ok := r.Extra["cmps/op"]; ok {
+			cmps = strconv.FormatFloat(v, 'f', 0, 64)
+		}
+		row([]string{c.algorithm, c.elem, c.dist, strconv.Itoa(c.n), strconv.FormatInt(r.NsPerOp(), 10),
+			strconv.FormatInt(r.AllocsPerOp(), 10), strconv.FormatInt(r.AllocedBytesPerOp(), 10), cmps})
+	}
+	return nil
+}
+
+// Benchmarks every sort for each element type, input distribution and length, named type/algorithm/distribution/n=length.
+// There are a lot of them, so select some with -bench.
+func BenchmarkSorts(b *testing.B) {
+	for _, c := range sortBenchmarkCases(sortBenchmarkMinPow, sortBenchmarkMaxPow) {
+		b.Run(c.name(), c.run)
+	}
+}
+
+// Flags of TestSortBenchmarkReport, which runs the benchmarks and writes a table instead of testing, for example:
+//
+//	go test -v -run '^TestSortBenchmarkReport$' -timeout 0 sort.go sort_test.go -report markdown -report.filter 'int/.*/uniform/n=65536'
+var (
+	sortReportFormat = flag.String("report", "", "run sort benchmarks and write results as csv or markdown")
+	sortReportFilter = flag.String("report.filter", "", "run only benchmarks with names like type/algorithm/distribution/n=length matching this regexp")
+	sortReportMinPow = flag.Int("report.minpow", sortBenchmarkMinPow, "benchmark inputs of lengths from 2^minpow")
+	sortReportMaxPow = flag.Int("report.maxpow", sortBenchmarkMaxPow, "benchmark inputs of lengths up to 2^maxpow")
+)
+
+func TestSortBenchmarkReport(t *testing.T) {
+	if *sortReportFormat == "" {
+		t.Skip("-report is not set")
+	}
+	var filter *regexp.Regexp
+	if *sortReportFilter != "" {
+		var err error
+		if filter, err = regexp.Compile(*sortReportFilter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sortBenchmarkReport(os.Stdout, *sortReportFormat, filter, *sortReportMinPow, *sortReportMaxPow); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSortBenchmarkReportFormats(t *testing.T) {
+	// Timings aren't checked, so a few runs are enough
+	benchtime := flag.Lookup("test.benchtime")
+	defer benchtime.Value.Set(benchtime.Value.String())
+	benchtime.Value.Set("10x")
+
+	// InsertionSort makes n*(n-1)/2 comparisons on any input
+	filter := regexp.MustCompile(`^uint16/InsertionSort/sorted/`)
+	var out bytes.Buffer
+	if err := sortBenchmarkReport(&out, "csv", filter, 4, 4); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[1][0] != "InsertionSort" || rows[1][3] != "16" || rows[1][7] != "120" {
+		t.Fatalf("got %q, want a header and a row of InsertionSort on 16 elements with 120 comparisons", rows)
+	}
+
+	if err := sortBenchmarkReport(&out, "json", filter, 4, 4); err == nil {
+		t.Fatal("unknown format is not reported")
+	}
+}
+
+func TestSorts(t *testing.T) {
+	for _, st := range sortTests {
+		t.Run(st.name, func(t *testing.T) {
+			forEachInput(func(input []uint16, dist string, seed uint16) {
+				xs := slices.Clone(input)
+				st.sort(xs, make([]uint16, len(xs)))
+				checkSorted(t, input, xs, "%s len=%d, seed=%d", dist, len(input), seed)
+			})
+		})
+	}
+}
+
+// Length of the input with a single outlier, long enough for a quadratic sort of one bucket to take seconds
+const integerSortOutlierTestLength = 1 << 16
+
+// Converts input to a signed type. Narrow values are in a small range around zero, so that CountSort counts them.
+// Wide values are spread over the whole range of T, and the first and the last ones are replaced with its maximum and minimum.
+func signedInput[T Signed](input []uint16, wide bool) []T {
+	bits := 8 * radixSortBytes[T]()
+	minT := T(-1) << (bits - 1)
+	xs := make([]T, len(input))
+	for i, x := range input {
+		v := int64(int16(x))
+		if bits < 16 {
+			v >>= 16 - bits
+		} else if wide {
+			v <<= bits - 16
+		}
+		xs[i] = T(v)
+	}
+	if wide && len(xs) >= 2 {
+		xs[0], xs[len(xs)-1] = ^minT, minT
+	}
+	return xs
+}
+
+func testSignedSorts[T Signed](t *testing.T) {
+	for _, st := range integerSortTests[T]() {
+		t.Run(st.name, func(t *testing.T) {
+			forEachInput(func(input []uint16, dist string, seed uint16) {
+				for _, wide := range []bool{false, true} {
+					xs := signedInput[T](input, wide)
+					want := slices.Sorted(slices.Values(xs))
+					st.sort(xs, make([]T, len(xs)))
+					if !slices.Equal(xs, want) {
+						t.Fatalf("%s len=%d, seed=%d, wide=%v: got %v, want %v", dist, len(input), seed, wide, xs, want)
+					}
+				}
+			})
+
+			// Keys in a small range and a single maximum put almost all elements into one bucket
+			xs := make([]T, integerSortOutlierTestLength)
+			seed := uint16(1)
+			for i := range xs {
+				seed = XorShift16(seed)
+				xs[i] = T(seed % 100)
+			}
+			xs[len(xs)/2] = ^(T(-1) << (8*radixSortBytes[T]() - 1))
+			want := slices.Sorted(slices.Values(xs))
+			st.sort(xs, make([]T, len(xs)))
+			if !slices.Equal(xs, want) {
+				t.Fatalf("outlier len=%d: output is not sorted", len(xs))
+			}
+		})
+	}
+}
+
+func TestSignedSorts(t *testing.T) {
+	t.Run("int8", testSignedSorts[int8])
+	t.Run("int16", testSignedSorts[int16])
+	t.Run("int32", testSignedSorts[int32])
+	t.Run("int64", testSignedSorts[int64])
+	t.Run("int", testSignedSorts[int])
+}
+
+// Checks CompareExchangeBranchless against CompareExchange on all pairs of xs
+func testCompareExchangeBranchless[T Integer](t *testing.T, xs []T) {
+	for _, a := range xs {
+		for _, b := range xs {
+			A, B := a, b
+			CompareExchangeBranchless(&A, &B)
+			wantA, wantB := a, b
+			CompareExchange(&wantA, &wantB)
+			if A != wantA || B != wantB {
+				t.Fatalf("CompareExchangeBranchless(%d, %d) = %d, %d, want %d, %d", a, b, A, B, wantA, wantB)
+			}
+		}
+	}
+}
+
+func TestCompareExchangeBranchless(t *testing.T) {
+	var int8s []int8
+	var uint8s []uint8
+	for i := range 256 {
+		int8s = append(int8s, int8(i))
+		uint8s = append(uint8s, uint8(i))
+	}
+	testCompareExchangeBranchless(t, int8s)
+	testCompareExchangeBranchless(t, uint8s)
+	testCompareExchangeBranchless(t, []int64{math.MinInt64, math.MinInt64 + 1, -1, 0, 1, math.MaxInt64 - 1, math.MaxInt64})
+	testCompareExchangeBranchless(t, []uint64{0, 1, math.MaxInt64, math.MaxInt64 + 1, math.MaxUint64 - 1, math.MaxUint64})
+	testCompareExchangeBranchless(t, []int{math.MinInt, -1, 0, 1, math.MaxInt})
+	testCompareExchangeBranchless(t, []uintptr{0, 1, math.MaxUint32, ^uintptr(0)})
+}
+
+// Sorts with exactly known counts of operations on reversed or sorted inputs of length n, which is a power of two
+var instrumentTests = []struct {
+	name     string
+	reversed bool
+	sort     func(xs []int, cmp func(a, b int) int)
+	want     func(n int) SortStats
+}{
+	// Compares every pair of positions once and exchanges every inverted pair
+	{"InsertionSort", true, InsertionSortFunc[int], func(n int) SortStats {
+		return SortStats{Comparisons: n * (n - 1) / 2, Exchanges: n * (n - 1) / 2, Moves: n * (n - 1)}
+	}},
+	// The last element is the pivot, so partitioning m elements scans all of them from the left and one from the right,
+	// splits off the pivot only and exchanges it with itself
+	{"QuickSort", false, QuickSortFunc[int], func(n int) SortStats {
+		return SortStats{Comparisons: (n - 1) * (n + 4) / 2, Exchanges: n - 1, Moves: 2 * (n - 1), MaxDepth: n}
+	}},
+	// On each of log2(n) levels, which are exact for lengths that are powers of two, copies every element to aux
+	// and back and compares on every step, since the left part is exhausted last
+	{"TopDownMergeSort", true, func(xs []int, cmp func(a, b int) int) { TopDownMergeSortFunc(xs, make([]int, len(xs)), cmp) },
+		func(n int) SortStats {
+			levels := bits.Len(uint(n - 1))
+			return SortStats{Comparisons: n * levels, Moves: 2 * n * levels, MaxDepth: levels + 1}
+		}},
+}
+
+func TestInstrument(t *testing.T) {
+	for _, tt := range instrumentTests {
+		for _, n := range []int{1, 2, 16, 128} {
+			xs := make([]int, n)
+			for i := range xs {
+				xs[i] = i
+				if tt.reversed {
+					xs[i] = n - i
+				}
+			}
+			stats := Instrument(cmp.Compare[int], func(cmp func(a, b int) int) { tt.sort(xs, cmp) })
+			if want := tt.want(n); stats != want {
+				t.Fatalf("%s len=%d: got %+v, want %+v", tt.name, n, stats, want)
+			}
+		}
+	}
+
+	// Parallel sorts and concurrent Instruments count their own comparisons only
+	input := make([]int, 2*sampleSortMinArrayLength)
+	for i := range input {
+		input[i] = int(XorShift16(uint16(i + 1)))
+	}
+	tests := []struct {
+		name string
+		sort func(xs []int, cmp func(a, b int) int)
+	}{
+		{"ParallelMergeSort", func(xs []int, cmp func(a, b int) int) { ParallelMergeSortFunc(xs, make([]int, len(xs)), 0, cmp) }},
+		{"ParallelQuickSort", func(xs []int, cmp func(a, b int) int) { ParallelQuickSortFunc(xs, 0, cmp) }},
+		{"SampleSort", func(xs []int, cmp func(a, b int) int) { SampleSortFunc(xs, make([]int, len(xs)), 0, cmp) }},
+		{"HybridQuickSort", func(xs []int, cmp func(a, b int) int) { HybridQuickSortFunc(xs, cmp) }},
+	}
+	var wg sync.WaitGroup
+	for _, tt := range tests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var want atomic.Int64
+			xs := slices.Clone(input)
+			stats := Instrument(func(a, b int) int {
+				want.Add(1)
+				return cmp.Compare(a, b)
+			}, func(cmp func(a, b int) int) { tt.sort(xs, cmp) })
+			if !IsSorted(xs) || stats.Comparisons != int(want.Load()) {
+				t.Errorf("%s: got %d comparisons, want %d, sorted %v", tt.name, stats.Comparisons, want.Load(), IsSorted(xs))
+			}
+			if stats.Moves < 2*stats.Exchanges || stats.Moves < len(xs)/2 {
+				t.Errorf("%s: got %d moves and %d exchanges", tt.name, stats.Moves, stats.Exchanges)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Length of inputs of TestParallelSorts, long enough for all parallel sorts to split work between goroutines
+const parallelSortTestLength = 2 * max(parallelMergeSortMinArrayLength, parallelQuickSortMinArrayLength, sampleSortMinArrayLength)
+
+// Parallel sorts, which sort inputs from forEachInput sequentially since they are short
+var parallelSortTests = []struct {
+	name   string
+	stable bool
+	sort   func(xs, aux []KeyIndex, workers int, cmp func(a, b KeyIndex) int)
+}{
+	{"ParallelMergeSort", true, ParallelMergeSortFunc[KeyIndex]},
+	{"ParallelQuickSort", false, func(xs, _ []KeyIndex, workers int, cmp func(a, b KeyIndex) int) {
+		ParallelQuickSortFunc(xs, workers, cmp)
+	}},
+	{"SampleSort", false, SampleSortFunc[KeyIndex]},
+}
+
+func TestParallelSorts(t *testing.T) {
+	buf := make([]uint16, parallelSortTestLength)
+	for _, st := range parallelSortTests {
+		t.Run(st.name, func(t *testing.T) {
+			for _, d := range inputDistributions {
+				d.fill(buf, 1)
+				for _, workers := range []int{0, 3} {
+					// Few distinct keys make many ties, Index tells them apart
+					keys := slices.Clone(buf)
+					if st.stable {
+						for i := range keys {
+							keys[i] %= stabilityTestKeys
+						}
+					}
+					xs := make([]KeyIndex, len(keys))
+					for i, x := range keys {
+						xs[i] = KeyIndex{x, i}
+					}
+					want := slices.Clone(xs)
+					slices.SortStableFunc(want, CompareKeyIndex)
+
+					st.sort(xs, make([]KeyIndex, len(xs)), workers, CompareKeyIndex)
+					if st.stable && !slices.Equal(xs, want) {
+						t.Fatalf("%s workers=%d: output is not sorted stably", d.name, workers)
+					}
+					got := make([]uint16, len(xs))
+					for i, x := range xs {
+						got[i] = x.Key
+					}
+					checkSorted(t, keys, got, "%s workers=%d", d.name, workers)
+				}
+			}
+		})
+	}
+}
+
+func TestStableSorts(t *testing.T) {
+	for _, st := range stableSortTests {
+		t.Run(st.name, func(t *testing.T) {
+			forEachInput(func(input []uint16, dist string, seed uint16) {
+				// Few distinct keys make many ties
+				xs := make([]KeyIndex, len(input))
+				for i, x := range input {
+					xs[i] = KeyIndex{x % stabilityTestKeys, i}
+				}
+				want := slices.Clone(xs)
+				slices.SortStableFunc(want, CompareKeyIndex)
+
+				st.sort(xs, make([]KeyIndex, len(xs)), CompareKeyIndex)
+				if !slices.Equal(xs, want) {
+					t.Fatalf("%s len=%d, seed=%d: output is not sorted stably", dist, len(input), seed)
+				}
+			})
+		})
+	}
+}
+
+// Partition used to exchange two elements equal to the pivot forever, so inputs of equal keys hung every quicksort
+func TestPartition(t *testing.T) {
+	forEachInput(func(input []uint16, dist string, seed uint16) {
+		if len(input) == 0 {
+			return
+		}
+		xs := slices.Clone(input)
+		done := make(chan int)
+		go func() { done <- Partition(xs) }()
+
+		var p int
+		select {
+		case p = <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s len=%d, seed=%d: Partition didn't return", dist, len(input), seed)
+		}
+		if !All(xs[:p], func(x uint16) bool { return x <= xs[p] }) || !All(xs[p+1:], func(x uint16) bool { return x >= xs[p] }) {
+			t.Fatalf("%s len=%d, seed=%d: output is not partitioned around xs[%d]", dist, len(input), seed, p)
+		}
+
+		// Equal keys stop both scans, so they are split evenly
+		if dist == "all equal" && (p < (len(xs)-1)/2-1 || p > len(xs)/2+1) {
+			t.Fatalf("%s len=%d, seed=%d: pivot position %d is not in the middle", dist, len(input), seed, p)
+		}
+	})
+}
+
+func TestSelects(t *testing.T) {
+	for _, st := range selectTests {
+		t.Run(st.name, func(t *testing.T) {
+			forEachInput(func(input []uint16, dist string, seed uint16) {
+				if len(input) == 0 {
+					return
+				}
+				for _, k := range []int{0, len(input) / 2, len(input) - 1, int(seed) % len(input)} {
+					xs := slices.Clone(input)
+					st.sel(xs, k)
+					checkSelected(t, input, xs, k, "%s len=%d, seed=%d, k=%d", dist, len(input), seed, k)
+				}
+			})
+		})
+	}
+}
+
+func TestPartialSort(t *testing.T) {
+	forEachInput(func(input []uint16, dist string, seed uint16) {
+		want := slices.Sorted(slices.Values(input))
+		for _, k := range []int{-1, 0, len(input) / 2, len(input), len(input) + 1, int(seed) % (len(input) + 1)} {
+			xs := slices.Clone(input)
+			PartialSort(xs, k)
+			k = max(0, min(k, len(input)))
+			if !slices.Equal(xs[:k], want[:k]) {
+				t.Fatalf("%s len=%d, seed=%d, k=%d: first k elements are not the smallest ones in sorted order", dist, len(input), seed, k)
+			}
+			if got := slices.Sorted(slices.Values(xs)); !slices.Equal(got, want) {
+				t.Fatalf("%s len=%d, seed=%d, k=%d: output is not a permutation of input", dist, len(input), seed, k)
+			}
+		}
+	})
+}
+
+func TestTopK(t *testing.T) {
+	forEachInput(func(input []uint16, dist string, seed uint16) {
+		sorted := slices.Sorted(slices.Values(input))
+		want := slices.Clone(sorted)
+		slices.Reverse(want)
+		for _, k := range []int{-1, 0, 1, len(input) / 2, len(input), len(input) + 1, int(seed) % (len(input) + 1), math.MaxInt} {
+			wantTop := want[:max(0, min(k, len(input)))]
+			if got := TopKSeq(slices.Values(input), k); !slices.Equal(got, wantTop) {
+				t.Fatalf("TopKSeq %s len=%d, seed=%d, k=%d: got %v, want %v", dist, len(input), seed, k, got, wantTop)
+			}
+			xs := slices.Clone(input)
+			if got := TopK(xs, k); !slices.Equal(got, wantTop) {
+				t.Fatalf("TopK %s len=%d, seed=%d, k=%d: got %v, want %v", dist, len(input), seed, k, got, wantTop)
+			}
+			if got := slices.Sorted(slices.Values(xs)); !slices.Equal(got, sorted) {
+				t.Fatalf("TopK %s len=%d, seed=%d, k=%d: output is not a permutation of input", dist, len(input), seed, k)
+			}
+		}
+	})
+}
+
+func TestMultiSelect(t *testing.T) {
+	forEachInput(func(input []uint16, dist string, seed uint16) {
+		n := len(input)
+		if n == 0 {
+			return
+		}
+		// Percentiles, duplicates, unsorted ks and a random one
+		for _, ks := range [][]int{
+			{n / 2, n * 9 / 10, n * 99 / 100},
+			{0, n - 1},
+			{n - 1, 0, n / 3, n / 3},
+			{int(seed) % n},
+		} {
+			xs := slices.Clone(input)
+			MultiSelect(xs, ks)
+			for _, k := range ks {
+				checkSelected(t, input, xs, k, "%s len=%d, seed=%d, ks=%v, k=%d", dist, n, seed, ks, k)
+			}
+		}
+	})
+}
+
+func TestMultiSelectOutOfRange(t *testing.T) {
+	for _, ks := range [][]int{{-1}, {3}, {2, 0, 3}, {1, -1}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("ks=%v: MultiSelect didn't panic", ks)
+				}
+			}()
+			MultiSelect([]int{3, 1, 2}, ks)
+		}()
+	}
+}
+
+// Lengths of inputs built by AntiQuickSort and MedianOfThreeKiller in the adversary tests
+var adversaryTestLengths = []int{256, 1024, 4096}
+
+// Hardened sorts make at most adversaryMaxComparisons*n*log2(n) comparisons on adversarial inputs
+const adversaryMaxComparisons = 5
+
+// IntroSelect makes at most adversarySelectMaxComparisons*n comparisons on adversarial inputs
+const adversarySelectMaxComparisons = 16
+
+// Unhardened quicksorts make at least n*n/adversaryQuadraticDivisor comparisons on adversarial inputs
+const adversaryQuadraticDivisor = 8
+
+// Hardened sorts and selects
+var adversaryTests = []struct {
+	name string
+	sort func(xs []int, cmp func(a, b int) int)
+	// Maximum number of comparisons for length n
+	maxComparisons func(n int) int
+}{
+	{"HybridQuickSort", HybridQuickSortFunc[int], func(n int) int { return adversaryMaxComparisons * n * bits.Len(uint(n-1)) }},
+	{"PdqSort", PdqSortFunc[int], func(n int) int { return adversaryMaxComparisons * n * bits.Len(uint(n-1)) }},
+	{"IntroSelect", func(xs []int, cmp func(a, b int) int) { IntroSelectFunc(xs, len(xs)/2, cmp) },
+		func(n int) int { return adversarySelectMaxComparisons * n }},
+}
+
+// Sorts a copy of input with sort, checks that the middle element is selected, which sorts do as well,
+// and returns the number of comparisons
+func adversaryComparisons(t *testing.T, input []int, sort func(xs []int, cmp func(a, b int) int), format string, args ...any) int {
+	t.Helper()
+	xs := slices.Clone(input)
+	stats := Instrument(cmp.Compare[int], func(cmp func(a, b int) int) { sort(xs, cmp) })
+	if k := len(xs) / 2; xs[k] != slices.Sorted(slices.Values(input))[k] {
+		t.Fatalf(format+": xs[%d] is not selected", append(args, k)...)
+	}
+	return stats.Comparisons
+}
+
+func TestAdversaryHardened(t *testing.T) {
+	for _, tt := range adversaryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, n := range adversaryTestLengths {
+				anti, _ := AntiQuickSort(n, tt.sort)
+				for _, k := range []struct {
+					name string
+					xs   []int
+				}{
+					{"antiquicksort", anti},
+					{"median-of-3 killer", MedianOfThreeKiller(n)},
+				} {
+					c := adversaryComparisons(t, k.xs, tt.sort, "%s len=%d", k.name, n)
+					if limit := tt.maxComparisons(n); c > limit {
+						t.Fatalf("%s len=%d: %d comparisons, want at most %d", k.name, n, c, limit)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAdversaryQuadratic(t *testing.T) {
+	tests := []struct {
+		name string
+		sort func(xs []int, cmp func(a, b int) int)
+	}{
+		{"QuickSort", QuickSortFunc[int]},
+		{"Select", func(xs []int, cmp func(a, b int) int) { SelectFunc(xs, len(xs)/2, cmp) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, n := range adversaryTestLengths {
+				anti, _ := AntiQuickSort(n, tt.sort)
+				if c, limit := adversaryComparisons(t, anti, tt.sort, "len=%d", n), n*n/adversaryQuadraticDivisor; c < limit {
+					t.Fatalf("len=%d: %d comparisons, want at least %d", n, c, limit)
+				}
+			}
+		})
+	}
+}
+
+// Reads the precomputed median-of-three killers, one input per line
+func readMedianOfThreeKillers(t *testing.T) [][]int {
+	t.Helper()
+	data, err := os.ReadFile("testdata/median_of_three_killers.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var killers [][]int
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var xs []int
+		for _, f := range strings.Fields(line) {
+			x, err := strconv.Atoi(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			xs = append(xs, x)
+		}
+		killers = append(killers, xs)
+	}
+	return killers
+}
+
+// The precomputed killers are regression inputs for HybridQuickSort, so they must still make
+// its quicksort without the depth limit quadratic, and the hardened sorts must resist them
+func TestMedianOfThreeKillers(t *testing.T) {
+	unlimited := func(xs []int, cmp func(a, b int) int) {
+		medianOfThreeQuickSort(xs, math.MaxInt, cmp)
+		InsertionSort2Func(xs, cmp)
+	}
+	for _, xs := range readMedianOfThreeKillers(t) {
+		n := len(xs)
+		if c, limit := adversaryComparisons(t, xs, unlimited, "len=%d", n), n*n/adversaryQuadraticDivisor; c < limit {
+			t.Fatalf("len=%d: %d comparisons without the depth limit, want at least %d", n, c, limit)
+		}
+		for _, tt := range adversaryTests {
+			if c, limit := adversaryComparisons(t, xs, tt.sort, "%s len=%d", tt.name, n), tt.maxComparisons(n); c > limit {
+				t.Fatalf("%s len=%d: %d comparisons, want at most %d", tt.name, n, c, limit)
+			}
+		}
+	}
+}
+
+// Operations on a Heap checked by testHeap
+const (
+	heapPush = iota
+	heapPop
+	heapReplaceTop
+)
+
+type heapOp struct {
+	op, x int
+}
+
+var heapTests = []struct {
+	name string
+	init []int
+	ops  []heapOp
+}{
+	{"empty", nil, nil},
+	{"push and pop", nil, []heapOp{{heapPush, 3}, {heapPush, 1}, {heapPush, 2}, {heapPop, 0}, {heapPop, 0}, {heapPop, 0}}},
+	{"heapify", []int{5, 3, 8, 1, 9, 2, 7}, []heapOp{{heapPop, 0}, {heapPop, 0}, {heapPush, 0}, {heapPop, 0}, {heapPop, 0}}},
+	{"duplicates", []int{2, 2, 1, 1}, []heapOp{{heapPush, 1}, {heapPush, 2}, {heapPop, 0}, {heapPop, 0}, {heapPop, 0}, {heapPop, 0}}},
+	{"pop to empty and push", []int{1}, []heapOp{{heapPop, 0}, {heapPush, 4}, {heapPush, -4}, {heapPop, 0}}},
+	{"replace top with smaller", []int{4, 6, 5}, []heapOp{{heapReplaceTop, 1}, {heapPop, 0}}},
+	{"replace top with greater", []int{4, 6, 5}, []heapOp{{heapReplaceTop, 10}, {heapPop, 0}, {heapPop, 0}}},
+	{"replace top with equal", []int{4, 4, 6}, []heapOp{{heapReplaceTop, 4}, {heapPop, 0}, {heapPop, 0}}},
+}
+
+// Applies ops to a heap created from init and checks it against a sorted slice with the same elements
+func testHeap(t *testing.T, init []int, ops []heapOp, format string, args ...any) {
+	t.Helper()
+	want := slices.Sorted(slices.Values(init))
+	h := NewHeap(slices.Clone(init))
+	for i, op := range ops {
+		switch op.op {
+		case heapPush:
+			h.Push(op.x)
+			j, _ := slices.BinarySearch(want, op.x)
+			want = slices.Insert(want, j, op.x)
+		case heapPop:
+			if got := h.Pop(); got != want[0] {
+				t.Fatalf(format+": op %d: Pop() = %d, want %d", append(args, i, got, want[0])...)
+			}
+			want = want[1:]
+		case heapReplaceTop:
+			if got := h.ReplaceTop(op.x); got != want[0] {
+				t.Fatalf(format+": op %d: ReplaceTop(%d) = %d, want %d", append(args, i, op.x, got, want[0])...)
+			}
+			j, _ := slices.BinarySearch(want[1:], op.x)
+			want = slices.Insert(want[1:], j, op.x)
+		}
+		if h.Len() != len(want) {
+			t.Fatalf(format+": op %d: Len() = %d, want %d", append(args, i, h.Len(), len(want))...)
+		}
+		if len(want) > 0 && h.Top() != want[0] {
+			t.Fatalf(format+": op %d: Top() = %d, want %d", append(args, i, h.Top(), want[0])...)
+		}
+	}
+}
+
+func TestHeap(t *testing.T) {
+	for _, ht := range heapTests {
+		t.Run(ht.name, func(t *testing.T) {
+			testHeap(t, ht.init, ht.ops, "%v", ht.init)
+		})
+	}
+
+	// Mixed operations chosen by the inputs, the first half of which is heapified
+	t.Run("generated", func(t *testing.T) {
+		forEachInput(func(input []uint16, dist string, seed uint16) {
+			init := make([]int, len(input)/2)
+			for i := range init {
+				init[i] = int(input[i])
+			}
+			ops := make([]heapOp, 0, len(input))
+			size := len(init)
+			for _, x := range input[len(init):] {
+				switch {
+				case x%4 == 0 && size > 0:
+					ops = append(ops, heapOp{heapPop, 0})
+					size--
+				case x%4 == 1 && size > 0:
+					ops = append(ops, heapOp{heapReplaceTop, int(x)})
+				default:
+					ops = append(ops, heapOp{heapPush, int(x)})
+					size++
+				}
+			}
+			for ; size > 0; size-- {
+				ops = append(ops, heapOp{heapPop, 0})
+			}
+			testHeap(t, init, ops, "%s len=%d, seed=%d", dist, len(input), seed)
+		})
+	})
+}
+
+// Splits keys at split, sorts both parts stably and checks that all merges give the same result as a stable sort
+func testMerges(t *testing.T, keys []uint16, split int) {
+	t.Helper()
+	xs := make([]KeyIndex, len(keys))
+	for i, x := range keys {
+		xs[i] = KeyIndex{x, i}
+	}
+	ys := xs[split:]
+	xs = xs[:split]
+	slices.SortStableFunc(xs, CompareKeyIndex)
+	slices.SortStableFunc(ys, CompareKeyIndex)
+	want := slices.Concat(xs, ys)
+	slices.SortStableFunc(want, CompareKeyIndex)
+
+	for _, mt := range mergeTests {
+		if got := mt.merge(slices.Clone(xs), slices.Clone(ys)); !slices.Equal(got, want) {
+			t.Fatalf("%s len(xs)=%d, len(ys)=%d: output is not a stable merge of inputs", mt.name, len(xs), len(ys))
+		}
+	}
+}
+
+func TestMerges(t *testing.T) {
+	forEachInput(func(input []uint16, dist string, seed uint16) {
+		keys := make([]uint16, len(input))
+		for i, x := range input {
+			keys[i] = x % stabilityTestKeys
+		}
+		for _, split := range []int{0, len(keys) / 3, len(keys)} {
+			testMerges(t, keys, split)
+		}
+	})
+}
+
+// Merges endless sorted producers, the consumer takes a few elements and cancels the merge.
+// The producers don't watch done, so only the merge itself can stop.
+func TestMergeChanDone(t *testing.T) {
+	for _, drain := range []bool{true, false} {
+		t.Run(fmt.Sprintf("drain=%v", drain), func(t *testing.T) {
+			done, stop := make(chan struct{}), make(chan struct{})
+			var producers sync.WaitGroup
+			defer producers.Wait()
+			defer close(stop)
+
+			chs := make([]<-chan int, 3)
+			for i := range chs {
+				ch := make(chan int)
+				chs[i] = ch
+				producers.Add(1)
+				go func() {
+					defer producers.Done()
+					for x := i; ; x += len(chs) {
+						select {
+						case ch <- x:
+						case <-stop:
+							return
+						}
+					}
+				}()
+			}
+
+			goroutines := runtime.NumGoroutine()
+			out := MergeChan(done, chs)
+			for want := 0; want < 10; want++ {
+				if got := <-out; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+			}
+			close(done)
+
+			// Either the output is closed, or the merging goroutine exits without anyone reading it
+			stopped := make(chan struct{})
+			go func() {
+				if drain {
+					for range out {
+					}
+				} else {
+					for runtime.NumGoroutine() > goroutines+1 {
+						time.Sleep(time.Millisecond)
+					}
+				}
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(time.Second):
+				t.Fatal("merge didn't stop after done was closed")
+			}
+		})
+	}
+}
+
+func TestMergeDebugChecks(t *testing.T) {
+	MergeDebugChecks = true
+	defer func() { MergeDebugChecks = false }()
+
+	// Valid merges pass the checks
+	forEachInput(func(input []uint16, dist string, seed uint16) {
+		testMerges(t, input, int(seed)%(len(input)+1))
+	})
+
+	sorted, unsorted := []int{1, 2, 3}, []int{3, 1, 2}
+	tests := []struct {
+		name  string
+		merge func()
+		want  error
+	}{
+		{"MergeInto", func() { MergeInto(make([]int, 6), sorted, unsorted) }, ErrUnsortedInput},
+		{"MergeInside", func() { MergeInside([]int{3, 1, 2, 4}, 1, make([]int, 4)) }, ErrUnsortedInput},
+		{"MergeInto2", func() { MergeInto2(make([]int, 6), unsorted, sorted, make([]int, 6)) }, ErrUnsortedInput},
+		{"MergeInto2/aux", func() { MergeInto2(make([]int, 6), sorted, sorted, make([]int, 5)) }, ErrAuxTooSmall},
+		{"MergeK", func() { MergeK(make([]int, 6), [][]int{sorted, unsorted}) }, ErrUnsortedInput},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if err, _ := recover().(error); !errors.Is(err, tt.want) {
+					t.Errorf("%s: got panic %v, want %v", tt.name, err, tt.want)
+				}
+			}()
+			tt.merge()
+		}()
+	}
+}
+
+func TestMergesChecked(t *testing.T) {
+	sorted, unsorted := []int{1, 2, 3}, []int{3, 1, 2}
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"MergeInto", MergeIntoChecked(make([]int, 6), sorted, sorted), nil},
+		{"MergeInto/out", MergeIntoChecked(make([]int, 5), sorted, sorted), ErrOutTooSmall},
+		{"MergeInto/xs", MergeIntoChecked(make([]int, 6), unsorted, sorted), ErrUnsortedInput},
+		{"MergeInto/ys", MergeIntoChecked(make([]int, 6), sorted, unsorted), ErrUnsortedInput},
+		{"MergeInside", MergeInsideChecked([]int{1, 3, 2, 4}, 1, make([]int, 4)), nil},
+		{"MergeInside/aux", MergeInsideChecked([]int{1, 3, 2, 4}, 1, make([]int, 3)), ErrAuxTooSmall},
+		{"MergeInside/unsorted", MergeInsideChecked([]int{3, 1, 2, 4}, 1, make([]int, 4)), ErrUnsortedInput},
+		{"MergeInside/m", MergeInsideChecked([]int{1, 3, 2, 4}, 4, make([]int, 4)), ErrIndexOutOfRange},
+		{"MergeInside/negative m", MergeInsideChecked([]int{1, 3, 2, 4}, -2, make([]int, 4)), ErrIndexOutOfRange},
+		{"MergeInto2", MergeInto2Checked(make([]int, 6), sorted, sorted, make([]int, 6)), nil},
+		{"MergeInto2/out", MergeInto2Checked(make([]int, 5), sorted, sorted, make([]int, 6)), ErrOutTooSmall},
+		{"MergeInto2/aux", MergeInto2Checked(make([]int, 6), sorted, sorted, make([]int, 5)), ErrAuxTooSmall},
+		{"MergeInto2/unsorted", MergeInto2Checked(make([]int, 6), sorted, unsorted, make([]int, 6)), ErrUnsortedInput},
+		{"TopDownMergeSortAB", TopDownMergeSortABChecked([]int{3, 2, 1}, make([]int, 3)), nil},
+		{"TopDownMergeSortAB/aux", TopDownMergeSortABChecked([]int{3, 2, 1}, make([]int, 2)), ErrAuxTooSmall},
+	}
+	for _, tt := range tests {
+		if !errors.Is(tt.err, tt.want) {
+			t.Errorf("%s: got error %v, want %v", tt.name, tt.err, tt.want)
+		}
+	}
+}
+
+func TestSortsChecked(t *testing.T) {
+	// Longer than sampleSortMinArrayLength, so that SampleSort uses aux
+	input := make([]int, 2*sampleSortMinArrayLength)
+	for i := range input {
+		input[i] = len(input) - i
+	}
+	tests := []struct {
+		name    string
+		checked func(xs, aux []int) error
+		sort    func(xs, aux []int)
+	}{
+		{"LSDRadixSort", LSDRadixSortChecked[int], LSDRadixSort[int]},
+		{"TimSort", TimSortChecked[int], TimSort[int]},
+		{"ParallelMergeSort", ParallelMergeSortChecked[int], ParallelMergeSort[int]},
+		{"SampleSort", SampleSortChecked[int], SampleSort[int]},
+		{"TopDownMergeSortAB", TopDownMergeSortABChecked[int], TopDownMergeSortAB[int]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xs := slices.Clone(input)
+			if err := tt.checked(xs, make([]int, len(xs))); err != nil || !IsSorted(xs) {
+				t.Fatalf("got error %v, sorted %v", err, IsSorted(xs))
+			}
+
+			// A short aux is reported without touching xs
+			xs = slices.Clone(input)
+			if err := tt.checked(xs, make([]int, len(xs)-1)); !errors.Is(err, ErrAuxTooSmall) || !slices.Equal(xs, input) {
+				t.Fatalf("got error %v, want %v", err, ErrAuxTooSmall)
+			}
+
+			// Unchecked sorts panic instead of exiting the process, even if aux has enough capacity
+			defer func() {
+				if recover() == nil {
+					t.Fatal("sort didn't panic on a short aux")
+				}
+			}()
+			tt.sort(slices.Clone(input), make([]int, len(input)-1, len(input)))
+		})
+	}
+}
+
+// Runs ExternalSort with temporary files in a test directory and checks that they are removed afterwards
+func runExternalSort(t *testing.T, in string, opts ExternalSortOptions) (string, error) {
+	t.Helper()
+	opts.TempDir = t.TempDir()
+	var out bytes.Buffer
+	err := ExternalSort(strings.NewReader(in), &out, opts)
+	if files, _ := os.ReadDir(opts.TempDir); len(files) != 0 {
+		t.Errorf("%d temporary files are left", len(files))
+	}
+	return out.String(), err
+}
+
+// Numbered lines "key index", where keys repeat, to check that equal keys keep their order
+func externalSortLines(n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%c %d", 'a'+XorShift16(uint16(i+1))%stabilityTestKeys, i)
+	}
+	return lines
+}
+
+// Compares lines by the key only
+func compareLineKeys(a, b []byte) int {
+	return cmp.Compare(a[0], b[0])
+}
+
+// Memory budget that fits a single record, so that every record becomes a run
+const externalSortOneRecordMemory = 1
+
+func TestExternalSort(t *testing.T) {
+	lines := externalSortLines(3*externalSortMaxFanIn + 1)
+	stableLines := slices.Clone(lines)
+	slices.SortStableFunc(stableLines, func(a, b string) int { return compareLineKeys([]byte(a), []byte(b)) })
+	sortedLines := slices.Sorted(slices.Values(lines))
+
+	tests := []struct {
+		name     string
+		in, want string
+		opts     ExternalSortOptions
+	}{
+		{"empty", "", "", ExternalSortOptions{}},
+		{"lines", "b\nc\na\n", "a\nb\nc\n", ExternalSortOptions{}},
+		{"empty lines", "b\n\na\n\n", "\n\na\nb\n", ExternalSortOptions{}},
+		{"no final newline", "b\nc\na", "a\nb\nc\n", ExternalSortOptions{}},
+		{"no final newline/runs", "b\nc\na", "a\nb\nc\n", ExternalSortOptions{Memory: externalSortOneRecordMemory}},
+		{"crlf", "b\r\nc\r\na\r\n", "a\r\nb\r\nc\r\n", ExternalSortOptions{}},
+		{"crlf/runs", "b\r\nc\r\na\r\n", "a\r\nb\r\nc\r\n", ExternalSortOptions{Memory: externalSortOneRecordMemory}},
+		// Newlines are ordinary bytes of fixed-width records
+		{"fixed", "ccc\naa\nbb", "\naa\nbbccc", ExternalSortOptions{RecordSize: 3}},
+		{"fixed/runs", "ccc\naa\nbb", "\naa\nbbccc", ExternalSortOptions{RecordSize: 3, Memory: externalSortOneRecordMemory}},
+		{"descending cmp", "b\nc\na\n", "c\nb\na\n", ExternalSortOptions{Cmp: func(a, b []byte) int { return bytes.Compare(b, a) }}},
+
+		// More runs than externalSortMaxFanIn are merged in several passes
+		{"multi-pass", strings.Join(lines, "\n"), strings.Join(sortedLines, "\n") + "\n",
+			ExternalSortOptions{Memory: externalSortOneRecordMemory}},
+		{"stable", strings.Join(lines, "\n") + "\n", strings.Join(stableLines, "\n") + "\n",
+			ExternalSortOptions{Cmp: compareLineKeys}},
+		{"stable/runs", strings.Join(lines, "\n") + "\n", strings.Join(stableLines, "\n") + "\n",
+			ExternalSortOptions{Memory: 10 * (4 + externalSortRecordOverhead), Cmp: compareLineKeys}},
+		{"stable/multi-pass", strings.Join(lines, "\n") + "\n", strings.Join(stableLines, "\n") + "\n",
+			ExternalSortOptions{Memory: externalSortOneRecordMemory, Cmp: compareLineKeys}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runExternalSort(t, tt.in, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExternalSortTruncatedRecord(t *testing.T) {
+	for _, memory := range []int{0, externalSortOneRecordMemory} {
+		_, err := runExternalSort(t, "aaabbbcc", ExternalSortOptions{RecordSize: 3, Memory: memory})
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("memory=%d: got error %v, want %v", memory, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+// Inputs reported by TestSort and the like, by distribution name, seed and length, added to the seed corpora.
+// Add failures found by the harness here to keep them covered.
+var fuzzSeeds = []struct {
+	dist   string
+	seed   uint16
+	length int
+}{
+	{"uniform", 3501, 19},
+	{"uniform", 1, 256},
+	{"sorted", 1, 100},
+	{"reverse sorted", 1, 100},
+	{"nearly sorted", 1, 100},
+	{"organ pipe", 1, 100},
+	{"sawtooth", 1, 100},
+	{"few unique", 1, 100},
+	{"all equal", 1, 100},
+	{"zipf", 1, 100},
+}
+
+// Generates the input of a fuzz seed encoded as fuzz data
+func fuzzSeedData(dist string, seed uint16, length int) []byte {
+	xs := make([]uint16, length)
+	for _, d := range inputDistributions {
+		if d.name == dist {
+			d.fill(xs, seed)
+		}
+	}
+	data := make([]byte, 2*length)
+	for i, x := range xs {
+		binary.LittleEndian.PutUint16(data[2*i:], x)
+	}
+	return data
+}
+
+// Decodes fuzz data into at most fuzzMaxLength elements
+func fuzzUint16s(data []byte) []uint16 {
+	xs := make([]uint16, min(len(data)/2, fuzzMaxLength))
+	for i := range xs {
+		xs[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+	return xs
+}
+
+func FuzzSort(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(fuzzSeedData(s.dist, s.seed, s.length))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		input := fuzzUint16s(data)
+		for _, st := range sortTests {
+			xs := slices.Clone(input)
+			st.sort(xs, make([]uint16, len(xs)))
+			checkSorted(t, input, xs, "%s", st.name)
+		}
+	})
+}
+
+func FuzzSelect(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(fuzzSeedData(s.dist, s.seed, s.length), s.seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, k uint16) {
+		input := fuzzUint16s(data)
+		if len(input) == 0 {
+			return
+		}
+		for _, st := range selectTests {
+			xs := slices.Clone(input)
+			st.sel(xs, int(k)%len(xs))
+			checkSelected(t, input, xs, int(k)%len(xs), "%s k=%d", st.name, int(k)%len(xs))
+		}
+	})
+}
+
+func FuzzMerge(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(fuzzSeedData(s.dist, s.seed, s.length), uint16(s.length/3))
+	}
+	f.Fuzz(func(t *testing.T, data []byte, split uint16) {
+		// Small keys make many ties
+		keys := fuzzUint16s(data)
+		for i := range keys {
+			keys[i] %= stabilityTestKeys
+		}
+		testMerges(t, keys, int(split)%(len(keys)+1))
+	})
+}